@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// --- API Token 鉴权 ---
+// 令牌文件每行一个令牌，格式为 "<token> <ro|rw>"，# 开头的是注释，例如:
+//
+//	# 前端只读
+//	s3cr3t-read ro
+//	# 运维脚本可写
+//	s3cr3t-write rw
+//
+// 请求需要带上 "Authorization: Bearer <token>" 头。
+// 加了 -open-read 时令牌文件可以不存在，相当于没有任何令牌：只读接口照常，写接口都返回 401。
+
+// role 表示令牌的权限等级，数值越大权限越高
+type role int
+
+const (
+	roleRead  role = iota + 1 // 只读：list / price / history
+	roleWrite                 // 读写：额外允许 create / update / delete
+)
+
+func (r role) String() string {
+	switch r {
+	case roleRead:
+		return "ro"
+	case roleWrite:
+		return "rw"
+	}
+	return "none"
+}
+
+// tokenEntry 只保存令牌的 SHA-256 摘要，比较时长度固定，不会泄露令牌长度
+type tokenEntry struct {
+	sum  [sha256.Size]byte
+	role role
+}
+
+type authenticator struct {
+	tokens   []tokenEntry
+	openRead bool // 为 true 时，只读接口不需要令牌
+}
+
+// loadTokens 从文件读取令牌列表
+func loadTokens(path string) ([]tokenEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var tokens []tokenEntry
+	input := bufio.NewScanner(f)
+	for n := 1; input.Scan(); n++ {
+		line := strings.TrimSpace(input.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: want \"<token> <ro|rw>\"", path, n)
+		}
+		var r role
+		switch fields[1] {
+		case "ro":
+			r = roleRead
+		case "rw":
+			r = roleWrite
+		default:
+			return nil, fmt.Errorf("%s:%d: unknown role %q", path, n, fields[1])
+		}
+		tokens = append(tokens, tokenEntry{sha256.Sum256([]byte(fields[0])), r})
+	}
+	if err := input.Err(); err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+// lookup 返回令牌对应的权限，找不到返回 0
+// 用常数时间比较，并且总是比完所有条目，避免按时间差猜令牌
+func (a *authenticator) lookup(token string) role {
+	sum := sha256.Sum256([]byte(token))
+	var found role
+	for _, t := range a.tokens {
+		if subtle.ConstantTimeCompare(sum[:], t.sum[:]) == 1 {
+			found = t.role
+		}
+	}
+	return found
+}
+
+// bearerToken 从 Authorization 头里取出令牌
+func bearerToken(req *http.Request) (string, bool) {
+	const prefix = "Bearer "
+	h := req.Header.Get("Authorization")
+	if len(h) < len(prefix) || !strings.EqualFold(h[:len(prefix)], prefix) {
+		return "", false
+	}
+	return strings.TrimSpace(h[len(prefix):]), true
+}
+
+// require 是鉴权中间件：只有权限不低于 need 的令牌才能调用 h
+// 没有令牌或令牌无效返回 401，权限不够返回 403
+func (a *authenticator) require(need role, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if need == roleRead && a.openRead {
+			h(w, req)
+			return
+		}
+
+		token, ok := bearerToken(req)
+		if !ok {
+			a.deny(w, req, http.StatusUnauthorized, "missing token")
+			return
+		}
+		got := a.lookup(token)
+		if got == 0 {
+			a.deny(w, req, http.StatusUnauthorized, "invalid token")
+			return
+		}
+		if got < need {
+			a.deny(w, req, http.StatusForbidden,
+				fmt.Sprintf("role %s cannot access %s", got, req.URL.Path))
+			return
+		}
+		h(w, req)
+	}
+}
+
+// deny 记录被拒绝的请求并返回错误码（日志里不会出现令牌本身）
+func (a *authenticator) deny(w http.ResponseWriter, req *http.Request, code int, reason string) {
+	slog.Warn("auth denied",
+		"method", req.Method,
+		"path", req.URL.Path,
+		"remote", req.RemoteAddr,
+		"status", code,
+		"reason", reason,
+	)
+	if code == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="inventory"`)
+	}
+	w.WriteHeader(code)
+	fmt.Fprintf(w, "%s\n", reason)
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// --- 批量事务 ---
+// POST /batch，请求体是一组操作，要么全部生效，要么全部不生效:
+//
+//	{"ops": [
+//	  {"op": "update", "item": "socks", "price": 6, "expect": {"price": 5}},
+//	  {"op": "create", "item": "hat", "price": 20},
+//	  {"op": "delete", "item": "shoes", "expect": {"exists": true}}
+//	]}
+//
+// expect 是前置条件：exists 要求商品存在（或不存在），price 要求商品存在且当前价格等于它。
+// 条件按顺序对“前面的操作都已生效”的状态求值，所以同一个批次里可以先建后改。
+// 整个批次在一次 db.mu 临界区内完成，其他请求看不到只改了一半的状态。
+
+const (
+	maxBatchOps   = 1000
+	maxBatchBytes = 1 << 20
+)
+
+type batchRequest struct {
+	Ops []batchOp `json:"ops"`
+}
+
+type batchOp struct {
+	Op     string        `json:"op"` // "create" / "update" / "delete"
+	Item   string        `json:"item"`
+	Price  *dollars      `json:"price,omitempty"`
+	Expect *precondition `json:"expect,omitempty"`
+}
+
+type precondition struct {
+	Exists *bool    `json:"exists,omitempty"`
+	Price  *dollars `json:"price,omitempty"`
+}
+
+// batchResult 是单个操作的结果
+// Status 为 "ok"（已生效）、"failed"（本操作导致整个批次回滚）或 "aborted"（因为别的操作失败而没有执行）
+type batchResult struct {
+	Op     string  `json:"op"`
+	Item   string  `json:"item"`
+	Status string  `json:"status"`
+	Error  string  `json:"error,omitempty"`
+	Old    dollars `json:"old,omitempty"`
+	Price  dollars `json:"price,omitempty"`
+}
+
+type batchResponse struct {
+	Applied bool          `json:"applied"`
+	Results []batchResult `json:"results"`
+}
+
+// stagedItem 是批次执行过程中某个商品的临时状态
+type stagedItem struct {
+	price  dollars
+	exists bool
+}
+
+// check 校验单个操作在当前（暂存）状态下能否执行，能执行就返回执行后的状态
+func (op batchOp) check(cur stagedItem) (stagedItem, error) {
+	if e := op.Expect; e != nil {
+		if e.Exists != nil && *e.Exists != cur.exists {
+			if cur.exists {
+				return cur, fmt.Errorf("precondition failed: item %q exists", op.Item)
+			}
+			return cur, fmt.Errorf("precondition failed: no such item: %q", op.Item)
+		}
+		if e.Price != nil && (!cur.exists || cur.price != *e.Price) {
+			return cur, fmt.Errorf("precondition failed: price of %q is not %s", op.Item, *e.Price)
+		}
+	}
+
+	switch op.Op {
+	case "create":
+		if cur.exists {
+			return cur, fmt.Errorf("item %q already exists", op.Item)
+		}
+		return stagedItem{*op.Price, true}, nil
+	case "update":
+		if !cur.exists {
+			return cur, fmt.Errorf("no such item: %q", op.Item)
+		}
+		return stagedItem{*op.Price, true}, nil
+	case "delete":
+		if !cur.exists {
+			return cur, fmt.Errorf("no such item: %q", op.Item)
+		}
+		return stagedItem{}, nil
+	}
+	return cur, fmt.Errorf("unknown op %q", op.Op)
+}
+
+// validate 检查与状态无关的参数错误
+func (op batchOp) validate() error {
+	if op.Item == "" {
+		return fmt.Errorf("item is required")
+	}
+	switch op.Op {
+	case "create", "update":
+		if op.Price == nil || *op.Price < 0 {
+			return fmt.Errorf("invalid price")
+		}
+	case "delete":
+	default:
+		return fmt.Errorf("unknown op %q", op.Op)
+	}
+	return nil
+}
+
+// [CUD] Batch: 原子地执行一组操作
+// URL: POST /batch
+func (db *database) batch(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		w.WriteHeader(http.StatusMethodNotAllowed) // 405
+		fmt.Fprint(w, "use POST\n")
+		return
+	}
+
+	var br batchRequest
+	dec := json.NewDecoder(http.MaxBytesReader(w, req.Body, maxBatchBytes))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&br); err != nil {
+		w.WriteHeader(http.StatusBadRequest) // 400
+		fmt.Fprintf(w, "invalid batch: %v\n", err)
+		return
+	}
+	if len(br.Ops) == 0 || len(br.Ops) > maxBatchOps {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "a batch needs 1..%d ops\n", maxBatchOps)
+		return
+	}
+
+	resp := batchResponse{Results: make([]batchResult, len(br.Ops))}
+	for i, op := range br.Ops {
+		resp.Results[i] = batchResult{Op: op.Op, Item: op.Item, Status: "aborted"}
+	}
+
+	// 参数错误不需要加锁就能发现
+	code := http.StatusOK
+	for i, op := range br.Ops {
+		if err := op.validate(); err != nil {
+			resp.Results[i].Status = "failed"
+			resp.Results[i].Error = err.Error()
+			code = http.StatusBadRequest
+		}
+	}
+	if code == http.StatusOK {
+		code = db.applyBatch(br.Ops, resp.Results)
+	}
+	resp.Applied = code == http.StatusOK
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// applyBatch 在一次临界区内先校验全部操作，全部通过后再真正写入
+// 结果写进 results，返回 HTTP 状态码：全部成功为 200，有冲突为 409
+func (db *database) applyBatch(ops []batchOp, results []batchResult) int {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	// 第一步：在暂存区里按顺序演练，db.store 一点都不动
+	staged := make(map[string]stagedItem)
+	lookup := func(item string) stagedItem {
+		if s, ok := staged[item]; ok {
+			return s
+		}
+		price, ok := db.store[item]
+		return stagedItem{price, ok}
+	}
+	olds := make([]stagedItem, len(ops))
+	for i, op := range ops {
+		olds[i] = lookup(op.Item)
+		next, err := op.check(olds[i])
+		if err != nil {
+			results[i].Status = "failed"
+			results[i].Error = err.Error()
+			return http.StatusConflict
+		}
+		staged[op.Item] = next
+	}
+
+	// 第二步：全部通过，真正写入并逐条记录变更
+	for i, op := range ops {
+		old := olds[i].price
+		switch op.Op {
+		case "create":
+			db.store[op.Item] = *op.Price
+			db.record("create", op.Item, 0, *op.Price)
+			results[i].Price = *op.Price
+		case "update":
+			db.store[op.Item] = *op.Price
+			db.record("update", op.Item, old, *op.Price)
+			results[i].Old, results[i].Price = old, *op.Price
+		case "delete":
+			delete(db.store, op.Item)
+			db.forgetStock(op.Item)
+			db.record("delete", op.Item, old, 0)
+			results[i].Old = old
+		}
+		results[i].Status = "ok"
+	}
+	return http.StatusOK
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// --- Server-Sent Events 变更推送 ---
+// 客户端连上 /events 后，会先收到它错过的事件，然后持续收到新事件，格式为:
+//
+//	id: 3
+//	event: update
+//	data: {"id":3,"time":"...","op":"update","item":"socks","old":5,"price":6}
+//
+// 断线重连时浏览器的 EventSource 会自动带上 Last-Event-ID 头，从断点继续推送；
+// 也可以用 /events?since=3 手动指定。加上 item=socks 只订阅单个商品。
+//
+// 连上时和之后每次心跳都会发一行注释 ": head 3"，告诉客户端服务端最新的事件序号，
+// 普通 SSE 客户端会忽略注释，从库（replica.go）用它计算复制延迟。
+//
+// 响应头 X-History-Epoch 是这份历史的标识。服务端重启（或者它本身是从库、重新同步了）之后
+// 序号从头开始，同一个序号指的就不是同一个事件了：标识会变，原来的连接也会被断开。
+
+const (
+	eventsHeartbeat    = 15 * time.Second // 没有事件时定期发注释行，防止代理断开空闲连接
+	eventsWriteTimeout = 10 * time.Second // 单次写入的最长时间，太慢的客户端会被断开
+)
+
+// [R] Events: 推送变更事件流
+// 注意：整个推送过程都不持有 db.mu，只在 db.since 里短暂加锁取事件，
+// 所以再慢的客户端也拖不住写请求
+func (db *database) events(w http.ResponseWriter, req *http.Request) {
+	last, err := lastEventID(req)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest) // 400
+		fmt.Fprintf(w, "%v\n", err)
+		return
+	}
+	item := req.URL.Query().Get("item")
+
+	_, _, epoch, _ := db.since(0)
+	rc := http.NewResponseController(w)
+	w.Header().Set("X-History-Epoch", epoch)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		slog.Error("events: streaming not supported", "remote", req.RemoteAddr, "err", err)
+		return
+	}
+
+	heartbeat := time.NewTicker(eventsHeartbeat)
+	defer heartbeat.Stop()
+
+	for first := true; ; first = false {
+		evs, head, current, wait := db.since(last)
+		if current != epoch {
+			return // 历史换了，让客户端带着新的标识重新订阅
+		}
+		last = head // 发完这一批就追平了（客户端给的序号比服务端还大时也以服务端为准）
+
+		// 每一轮写入都设一个截止时间（不支持的 ResponseWriter 会返回错误，忽略即可）
+		rc.SetWriteDeadline(time.Now().Add(eventsWriteTimeout))
+		for _, c := range evs {
+			if item != "" && c.Item != item {
+				continue
+			}
+			data, _ := json.Marshal(c)
+			if _, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", c.ID, c.Op, data); err != nil {
+				return // 客户端断开或写超时
+			}
+		}
+		if first {
+			if _, err := fmt.Fprintf(w, ": head %d\n\n", last); err != nil {
+				return
+			}
+		}
+		if len(evs) > 0 || first {
+			if err := rc.Flush(); err != nil {
+				return
+			}
+		}
+
+		select {
+		case <-wait:
+			// 有新事件，进入下一轮
+		case <-heartbeat.C:
+			rc.SetWriteDeadline(time.Now().Add(eventsWriteTimeout))
+			if _, err := fmt.Fprintf(w, ": head %d\n\n", last); err != nil {
+				return
+			}
+			if err := rc.Flush(); err != nil {
+				return
+			}
+		case <-req.Context().Done():
+			return
+		}
+	}
+}
+
+// lastEventID 读取客户端已经收到的最后一个事件序号
+// 优先使用 Last-Event-ID 头，其次是 since 参数，都没有就从头推送
+func lastEventID(req *http.Request) (int64, error) {
+	s := req.Header.Get("Last-Event-ID")
+	if s == "" {
+		s = req.URL.Query().Get("since")
+	}
+	if s == "" {
+		return 0, nil
+	}
+	id, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || id < 0 {
+		return 0, fmt.Errorf("invalid event id: %q", s)
+	}
+	return id, nil
+}
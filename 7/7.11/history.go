@@ -0,0 +1,140 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// --- 变更历史 ---
+// 每一次 create / update / delete 都会记成一条带时间戳的 change。
+// 这样旧价格不会被 db.store 直接覆盖掉，审计时可以查到任意时刻的价格。
+// 库存数量的变化记成 op 为 "stock" 的事件（见 stock.go）。
+
+// change 是一条变更事件
+type change struct {
+	ID    int64     `json:"id"`              // 递增序号，从 1 开始
+	Time  time.Time `json:"time"`            // 发生时间 (UTC)
+	Op    string    `json:"op"`              // "create" / "update" / "delete" / "stock"
+	Item  string    `json:"item"`            // 商品名
+	Old   dollars   `json:"old"`             // 变更前的价格（create 时为 0）
+	Price dollars   `json:"price"`           // 变更后的价格（delete 时为 0）
+	Stock *int      `json:"stock,omitempty"` // 变更后的可售库存，只有 stock 事件才有
+}
+
+func (c change) String() string {
+	if c.Op == "stock" {
+		return fmt.Sprintf("#%d %s stock %s: %d available",
+			c.ID, c.Time.Format(time.RFC3339), c.Item, *c.Stock)
+	}
+	return fmt.Sprintf("#%d %s %s %s: %s -> %s",
+		c.ID, c.Time.Format(time.RFC3339), c.Op, c.Item, c.Old, c.Price)
+}
+
+// record 追加一条价格变更事件
+// 注意：调用者必须已经持有 db.mu
+func (db *database) record(op, item string, old, price dollars) {
+	db.appendChange(change{Op: op, Item: item, Old: old, Price: price})
+}
+
+// appendChange 给事件编号、打时间戳后发布出去
+// 注意：调用者必须已经持有 db.mu
+func (db *database) appendChange(c change) {
+	c.ID = int64(len(db.history)) + 1
+	c.Time = time.Now().UTC()
+	db.publish(c)
+}
+
+// publish 把已经编好号的事件追加到 history，并唤醒所有在等新事件的订阅者
+// 从库复制时直接调用它，保留主库的序号和时间
+// 注意：调用者必须已经持有 db.mu
+func (db *database) publish(c change) {
+	db.history = append(db.history, c)
+	// 关闭旧通道就是一次广播；再换一个新通道给下一批等待者
+	close(db.changed)
+	db.changed = make(chan struct{})
+}
+
+// since 返回序号大于 id 的所有事件、当前最新的事件序号、历史的标识，以及一个在下一条事件到来时会被关闭的通道
+// 返回的切片只读：history 只会追加，已有的元素不会再被修改，所以解锁后读取也是安全的
+func (db *database) since(id int64) ([]change, int64, string, <-chan struct{}) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	head := int64(len(db.history))
+	if id < 0 {
+		id = 0
+	}
+	if id > head {
+		id = head
+	}
+	return db.history[id:], head, db.epoch, db.changed
+}
+
+// snapshotAt 重放历史，得到 t 时刻（含）的商品目录
+// 注意：调用者必须已经持有 db.mu
+func (db *database) snapshotAt(t time.Time) map[string]dollars {
+	store := make(map[string]dollars)
+	for _, c := range db.history {
+		// history 按时间追加，遇到第一条晚于 t 的就可以停了
+		if c.Time.After(t) {
+			break
+		}
+		switch c.Op {
+		case "create", "update":
+			store[c.Item] = c.Price
+		case "delete":
+			delete(store, c.Item)
+		}
+	}
+	return store
+}
+
+// [R] History: 列出变更事件
+// URL: /history?item=socks （不带 item 则列出全部）
+func (db *database) historyOf(w http.ResponseWriter, req *http.Request) {
+	item := req.URL.Query().Get("item")
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	found := false
+	for _, c := range db.history {
+		if item != "" && c.Item != item {
+			continue
+		}
+		found = true
+		fmt.Fprintln(w, c)
+	}
+	if !found && item != "" {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "no history for item: %q\n", item)
+	}
+}
+
+// newDatabase 用初始数据建库，并把初始数据也记成 create 事件
+// 这样重放历史时不会丢掉最早的那批商品
+func newDatabase(seed map[string]dollars) *database {
+	db := &database{
+		store:        make(map[string]dollars),
+		changed:      make(chan struct{}),
+		epoch:        rand.Text(),
+		stock:        make(map[string]int),
+		reservations: make(map[string]*reservation),
+	}
+
+	// map 遍历顺序随机，排个序让事件序号稳定
+	items := make([]string, 0, len(seed))
+	for item := range seed {
+		items = append(items, item)
+	}
+	sort.Strings(items)
+
+	for _, item := range items {
+		db.store[item] = seed[item]
+		db.record("create", item, 0, seed[item])
+	}
+	return db
+}
@@ -0,0 +1,498 @@
+/*
+invctl 是库存服务 (7/7.11) 的命令行客户端，用来代替手敲 curl。
+
+用法:
+
+	invctl [全局参数] <命令> [参数]
+
+	invctl list [-prefix p] [-q s] [-min n] [-max n] [-sort name|price] [-desc] [-limit n] [-all]
+	invctl price  <item>
+	invctl create <item> <price> [stock]
+	invctl update <item> <price>
+	invctl delete <item>
+	invctl import [-upsert] <file.csv>     每行 "item,price"，通过 /batch 导入，每批最多 1000 行
+
+全局参数:
+
+	-server   服务地址，默认取环境变量 INVCTL_SERVER，再默认 http://localhost:8000
+	-token    API 令牌，默认取环境变量 INVCTL_TOKEN
+	-o        输出格式 table（默认）或 json
+
+退出码:
+
+	0 成功   1 网络或其他错误   2 用法错误   3 商品不存在 (404)
+	4 未授权或无权限 (401/403)   5 参数错误 (400)   6 冲突 (409/410)   7 服务端错误 (5xx)
+*/
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// 退出码
+const (
+	exitOK = iota
+	exitError
+	exitUsage
+	exitNotFound
+	exitAuth
+	exitInvalid
+	exitConflict
+	exitServer
+)
+
+// --- 1. 基础定义 ---
+
+type item struct {
+	Name  string  `json:"item"`
+	Price float64 `json:"price"`
+}
+
+// statusError 表示服务端返回了非 2xx 状态码
+type statusError struct {
+	code int
+	msg  string
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("%d %s: %s", e.code, http.StatusText(e.code), e.msg)
+}
+
+// exitCode 把错误映射成退出码
+func exitCode(err error) int {
+	var se *statusError
+	if !errors.As(err, &se) {
+		return exitError
+	}
+	switch {
+	case se.code == http.StatusNotFound:
+		return exitNotFound
+	case se.code == http.StatusUnauthorized, se.code == http.StatusForbidden:
+		return exitAuth
+	case se.code == http.StatusBadRequest:
+		return exitInvalid
+	case se.code == http.StatusConflict, se.code == http.StatusGone:
+		return exitConflict
+	case se.code >= 500:
+		return exitServer
+	}
+	return exitError
+}
+
+// usageError 表示命令行参数不对
+type usageError string
+
+func (e usageError) Error() string { return string(e) }
+
+// --- 2. HTTP 客户端 ---
+
+type client struct {
+	server string
+	token  string
+	http   *http.Client
+}
+
+// do 发送请求，返回响应体和响应头；非 2xx 状态码转成 *statusError
+func (c *client) do(method, path string, query url.Values, body io.Reader) ([]byte, http.Header, error) {
+	u := strings.TrimRight(c.server, "/") + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return nil, nil, err
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	// 409 的 /batch 响应也要交给调用者解析，所以把响应体一起带上
+	if resp.StatusCode/100 != 2 {
+		return data, resp.Header, &statusError{resp.StatusCode, strings.TrimSpace(string(data))}
+	}
+	return data, resp.Header, nil
+}
+
+// parseItems 解析 /list 返回的 "name: $price" 文本
+func parseItems(data []byte) ([]item, error) {
+	var items []item
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		if line == "" {
+			continue
+		}
+		i := strings.LastIndex(line, ": ")
+		if i < 0 {
+			return nil, fmt.Errorf("unexpected line from server: %q", line)
+		}
+		price, err := parsePrice(line[i+2:])
+		if err != nil {
+			return nil, fmt.Errorf("unexpected line from server: %q", line)
+		}
+		items = append(items, item{line[:i], price})
+	}
+	return items, nil
+}
+
+// parsePrice 解析 "$5.00" 或 "5"
+func parsePrice(s string) (float64, error) {
+	return strconv.ParseFloat(strings.TrimPrefix(strings.TrimSpace(s), "$"), 64)
+}
+
+// --- 3. 输出 ---
+
+type printer struct {
+	json bool
+	out  io.Writer
+}
+
+func (p *printer) items(items []item) {
+	if p.json {
+		if items == nil {
+			items = []item{}
+		}
+		p.encode(items)
+		return
+	}
+	tw := tabwriter.NewWriter(p.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ITEM\tPRICE")
+	for _, it := range items {
+		fmt.Fprintf(tw, "%s\t$%.2f\n", it.Name, it.Price)
+	}
+	tw.Flush()
+}
+
+// message 输出写操作的结果
+func (p *printer) message(msg string) {
+	if p.json {
+		p.encode(map[string]any{"ok": true, "message": msg})
+		return
+	}
+	fmt.Fprintln(p.out, msg)
+}
+
+func (p *printer) encode(v any) {
+	enc := json.NewEncoder(p.out)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+// --- 4. 子命令 ---
+
+func cmdList(c *client, p *printer, args []string) error {
+	fs := flag.NewFlagSet("list", flag.ContinueOnError)
+	prefix := fs.String("prefix", "", "name prefix")
+	substr := fs.String("q", "", "name substring")
+	min := fs.String("min", "", "minimum price")
+	max := fs.String("max", "", "maximum price")
+	sortBy := fs.String("sort", "name", "sort by name or price")
+	desc := fs.Bool("desc", false, "sort in descending order")
+	limit := fs.Int("limit", 0, "page size (server default if 0)")
+	all := fs.Bool("all", false, "follow the cursor and fetch every page")
+	if err := fs.Parse(args); err != nil {
+		return usageError(err.Error())
+	}
+
+	q := url.Values{}
+	for k, v := range map[string]string{"prefix": *prefix, "q": *substr, "min": *min, "max": *max, "sort": *sortBy} {
+		if v != "" {
+			q.Set(k, v)
+		}
+	}
+	if *desc {
+		q.Set("order", "desc")
+	}
+	if *limit > 0 {
+		q.Set("limit", strconv.Itoa(*limit))
+	}
+
+	var items []item
+	for {
+		data, hdr, err := c.do(http.MethodGet, "/list", q, nil)
+		if err != nil {
+			return err
+		}
+		page, err := parseItems(data)
+		if err != nil {
+			return err
+		}
+		items = append(items, page...)
+
+		next := hdr.Get("X-Next-Cursor")
+		if !*all || next == "" {
+			if next != "" && !p.json {
+				fmt.Fprintf(os.Stderr, "more results: use -all to fetch every page\n")
+			}
+			break
+		}
+		q.Set("cursor", next)
+	}
+	p.items(items)
+	return nil
+}
+
+func cmdPrice(c *client, p *printer, args []string) error {
+	if len(args) != 1 {
+		return usageError("usage: invctl price <item>")
+	}
+	data, _, err := c.do(http.MethodGet, "/price", url.Values{"item": {args[0]}}, nil)
+	if err != nil {
+		return err
+	}
+	price, err := parsePrice(string(data))
+	if err != nil {
+		return fmt.Errorf("unexpected response from server: %q", data)
+	}
+	p.items([]item{{args[0], price}})
+	return nil
+}
+
+// cmdWrite 处理 create / update / delete 这类“参数放进查询串”的写操作
+func cmdWrite(c *client, p *printer, name string, args []string) error {
+	var q url.Values
+	switch {
+	case name == "create" && (len(args) == 2 || len(args) == 3):
+		q = url.Values{"item": {args[0]}, "price": {args[1]}}
+		if len(args) == 3 {
+			q.Set("stock", args[2])
+		}
+	case name == "update" && len(args) == 2:
+		q = url.Values{"item": {args[0]}, "price": {args[1]}}
+	case name == "delete" && len(args) == 1:
+		q = url.Values{"item": {args[0]}}
+	default:
+		return usageError(usage)
+	}
+	data, _, err := c.do(http.MethodGet, "/"+name, q, nil)
+	if err != nil {
+		return err
+	}
+	p.message(strings.TrimSpace(string(data)))
+	return nil
+}
+
+// maxBatchOps 和服务端 batch.go 里的上限一致，一个 /batch 最多这么多条操作
+const maxBatchOps = 1000
+
+type batchOp struct {
+	Op     string          `json:"op"`
+	Item   string          `json:"item"`
+	Price  float64         `json:"price"`
+	Expect map[string]bool `json:"expect"`
+}
+
+type batchResult struct {
+	Op     string `json:"op"`
+	Item   string `json:"item"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// cmdImport 读取 CSV 并通过 /batch 导入，每批最多 maxBatchOps 行
+// 每一批是原子的：要么全部导入，要么一条都不导入；某一批失败时，前面的批已经导入了，后面的不再发
+func cmdImport(c *client, p *printer, args []string) error {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	upsert := fs.Bool("upsert", false, "update items that already exist instead of failing")
+	if err := fs.Parse(args); err != nil {
+		return usageError(err.Error())
+	}
+	if fs.NArg() != 1 {
+		return usageError("usage: invctl import [-upsert] <file.csv>")
+	}
+
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = 2
+	r.Comment = '#'
+	records, err := r.ReadAll()
+	if err != nil {
+		return err
+	}
+
+	// -upsert 时先取一遍现有商品，决定每一行是 create 还是 update
+	existing := make(map[string]bool)
+	if *upsert {
+		q := url.Values{"limit": {"1000"}}
+		for {
+			data, hdr, err := c.do(http.MethodGet, "/list", q, nil)
+			if err != nil {
+				return err
+			}
+			page, err := parseItems(data)
+			if err != nil {
+				return err
+			}
+			for _, it := range page {
+				existing[it.Name] = true
+			}
+			next := hdr.Get("X-Next-Cursor")
+			if next == "" {
+				break
+			}
+			q.Set("cursor", next)
+		}
+	}
+
+	var ops []batchOp
+	for i, rec := range records {
+		name := strings.TrimSpace(rec[0])
+		price, err := parsePrice(rec[1])
+		if err != nil || name == "" {
+			return fmt.Errorf("%s: line %d: want \"item,price\"", fs.Arg(0), i+1)
+		}
+		// 带上前置条件：如果在读取列表之后有人改了商品，整个导入会失败而不是覆盖
+		op := batchOp{Op: "create", Item: name, Price: price, Expect: map[string]bool{"exists": false}}
+		if existing[name] {
+			op.Op, op.Expect["exists"] = "update", true
+		}
+		ops = append(ops, op)
+	}
+	if len(ops) == 0 {
+		return fmt.Errorf("%s: nothing to import", fs.Arg(0))
+	}
+
+	// 各批的逐条结果合在一起打印；applied 表示所有的批都导入了
+	var resp struct {
+		Applied bool          `json:"applied"`
+		Results []batchResult `json:"results"`
+	}
+	imported, batches := 0, (len(ops)+maxBatchOps-1)/maxBatchOps
+	for len(ops) > 0 {
+		chunk := ops[:min(len(ops), maxBatchOps)]
+		ops = ops[len(chunk):]
+		body, _ := json.Marshal(map[string]any{"ops": chunk})
+		var data []byte
+		data, _, err = c.do(http.MethodPost, "/batch", nil, bytes.NewReader(body))
+
+		// 失败时响应体里也有逐条结果，先解析出来给用户看
+		var br struct {
+			Applied bool          `json:"applied"`
+			Results []batchResult `json:"results"`
+		}
+		if json.Unmarshal(data, &br) != nil {
+			if imported > 0 && err != nil {
+				err = fmt.Errorf("%w (%d items from earlier batches were already imported)", err, imported)
+			}
+			return err
+		}
+		resp.Applied = br.Applied
+		resp.Results = append(resp.Results, br.Results...)
+		if err != nil || !br.Applied {
+			break
+		}
+		imported += len(chunk)
+	}
+	if p.json {
+		p.encode(resp)
+	} else {
+		tw := tabwriter.NewWriter(p.out, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "OP\tITEM\tSTATUS\tERROR")
+		for _, r := range resp.Results {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", r.Op, r.Item, r.Status, r.Error)
+		}
+		tw.Flush()
+	}
+	// 逐条结果已经打印过了，错误信息里不用再带一遍原始 JSON
+	var se *statusError
+	if errors.As(err, &se) {
+		se.msg = "batch rejected, nothing imported"
+		if imported > 0 {
+			se.msg = fmt.Sprintf("batch %d of %d rejected, %d items from earlier batches were imported and the rest were not",
+				imported/maxBatchOps+1, batches, imported)
+		}
+	}
+	return err
+}
+
+// --- 5. 主程序 ---
+
+const usage = `usage: invctl [-server url] [-token t] [-o table|json] <command> [args]
+
+commands:
+  list [-prefix p] [-q s] [-min n] [-max n] [-sort name|price] [-desc] [-limit n] [-all]
+  price  <item>
+  create <item> <price> [stock]
+  update <item> <price>
+  delete <item>
+  import [-upsert] <file.csv>`
+
+func main() {
+	os.Exit(run(os.Args[1:]))
+}
+
+func run(args []string) int {
+	fs := flag.NewFlagSet("invctl", flag.ContinueOnError)
+	fs.Usage = func() { fmt.Fprintln(os.Stderr, usage) }
+	server := fs.String("server", envOr("INVCTL_SERVER", "http://localhost:8000"), "inventory server URL")
+	token := fs.String("token", os.Getenv("INVCTL_TOKEN"), "API token")
+	output := fs.String("o", "table", "output format: table or json")
+	timeout := fs.Duration("timeout", 10*time.Second, "request timeout")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	if fs.NArg() == 0 || (*output != "table" && *output != "json") {
+		fs.Usage()
+		return exitUsage
+	}
+
+	c := &client{server: *server, token: *token, http: &http.Client{Timeout: *timeout}}
+	p := &printer{json: *output == "json", out: os.Stdout}
+
+	var err error
+	switch cmd, rest := fs.Arg(0), fs.Args()[1:]; cmd {
+	case "list":
+		err = cmdList(c, p, rest)
+	case "price":
+		err = cmdPrice(c, p, rest)
+	case "create", "update", "delete":
+		err = cmdWrite(c, p, cmd, rest)
+	case "import":
+		err = cmdImport(c, p, rest)
+	default:
+		err = usageError(fmt.Sprintf("unknown command %q\n%s", cmd, usage))
+	}
+
+	if err == nil {
+		return exitOK
+	}
+	fmt.Fprintf(os.Stderr, "invctl: %v\n", err)
+	if _, ok := err.(usageError); ok {
+		return exitUsage
+	}
+	return exitCode(err)
+}
+
+func envOr(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
@@ -0,0 +1,132 @@
+// Package invrpc 是库存服务 (7/7.11) JSON-RPC 接口的客户端。
+// 服务端和客户端共用这里定义的参数和返回值类型。
+//
+// 用法:
+//
+//	c, err := invrpc.Dial("localhost:8001", "s3cr3t-write")
+//	if err != nil { ... }
+//	defer c.Close()
+//	item, err := c.Update("socks", 6)
+//	if errors.Is(err, invrpc.ErrNotFound) { ... }
+package invrpc
+
+import (
+	"errors"
+	"fmt"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"strings"
+)
+
+// ServiceName 是服务端注册的 RPC 服务名，方法名为 "Inventory.List" 这样的形式
+const ServiceName = "Inventory"
+
+// 服务端返回的错误。net/rpc 只传错误字符串，客户端按前缀还原成这些哨兵错误，
+// 所以可以用 errors.Is 判断
+var (
+	ErrNotFound     = errors.New("inventory: no such item")
+	ErrExists       = errors.New("inventory: item already exists")
+	ErrInvalid      = errors.New("inventory: invalid argument")
+	ErrUnauthorized = errors.New("inventory: missing or invalid token")
+	ErrForbidden    = errors.New("inventory: permission denied")
+	ErrReadOnly     = errors.New("inventory: read-only follower")
+)
+
+var sentinels = []error{ErrNotFound, ErrExists, ErrInvalid, ErrUnauthorized, ErrForbidden, ErrReadOnly}
+
+// Item 是一件商品
+type Item struct {
+	Name  string
+	Price float64
+	Stock int // 可售库存
+}
+
+// ItemArgs 是单个商品操作的参数，Get 和 Delete 只用到 Name
+type ItemArgs struct {
+	Token string
+	Name  string
+	Price float64
+	Stock int // 只有 Create 会用到
+}
+
+// ListArgs 是 List 的参数，Prefix 为空表示全部
+type ListArgs struct {
+	Token  string
+	Prefix string
+}
+
+// ListReply 按名字排好序
+type ListReply struct {
+	Items []Item
+}
+
+// Client 是一个 JSON-RPC 连接，可以被多个 goroutine 同时使用
+type Client struct {
+	rpc   *rpc.Client
+	token string
+}
+
+// Dial 连接 addr 上的库存 RPC 服务，之后每次调用都会带上 token
+func Dial(addr, token string) (*Client, error) {
+	c, err := jsonrpc.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{rpc: c, token: token}, nil
+}
+
+func (c *Client) Close() error { return c.rpc.Close() }
+
+// List 列出名字以 prefix 开头的商品
+func (c *Client) List(prefix string) ([]Item, error) {
+	var reply ListReply
+	err := c.call("List", &ListArgs{Token: c.token, Prefix: prefix}, &reply)
+	return reply.Items, err
+}
+
+// Get 读取单个商品
+func (c *Client) Get(name string) (Item, error) {
+	var item Item
+	err := c.call("Get", &ItemArgs{Token: c.token, Name: name}, &item)
+	return item, err
+}
+
+// Create 创建商品，stock 为初始库存
+func (c *Client) Create(name string, price float64, stock int) (Item, error) {
+	var item Item
+	err := c.call("Create", &ItemArgs{Token: c.token, Name: name, Price: price, Stock: stock}, &item)
+	return item, err
+}
+
+// Update 修改价格，返回修改后的商品
+func (c *Client) Update(name string, price float64) (Item, error) {
+	var item Item
+	err := c.call("Update", &ItemArgs{Token: c.token, Name: name, Price: price}, &item)
+	return item, err
+}
+
+// Delete 删除商品，返回删除前的商品
+func (c *Client) Delete(name string) (Item, error) {
+	var item Item
+	err := c.call("Delete", &ItemArgs{Token: c.token, Name: name}, &item)
+	return item, err
+}
+
+func (c *Client) call(method string, args, reply any) error {
+	err := c.rpc.Call(ServiceName+"."+method, args, reply)
+	var se rpc.ServerError
+	if errors.As(err, &se) {
+		return decodeError(string(se))
+	}
+	return err
+}
+
+// decodeError 把服务端的错误字符串还原成包装了哨兵错误的 error
+func decodeError(msg string) error {
+	for _, e := range sentinels {
+		if rest, ok := strings.CutPrefix(msg, e.Error()); ok {
+			return fmt.Errorf("%w%s", e, rest)
+		}
+	}
+	return errors.New(msg)
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// --- /list 的过滤、排序与分页 ---
+// 支持的查询参数:
+//
+//	prefix=so      名字前缀
+//	q=ock          名字包含的子串
+//	min=1&max=10   价格区间（闭区间）
+//	sort=price     按 name（默认）或 price 排序
+//	order=desc     asc（默认）或 desc
+//	limit=50       每页条数，默认 100，最多 1000
+//	cursor=...     上一页响应头 X-Next-Cursor 里的值
+//
+// 价格相同时按名字排，所以顺序总是确定的。
+// 游标记录的是上一页最后一条的 (价格, 名字)，翻页期间有增删也不会重复或漏项。
+
+const (
+	defaultListLimit = 100
+	maxListLimit     = 1000
+)
+
+type listItem struct {
+	Name  string
+	Price dollars
+}
+
+type listQuery struct {
+	prefix, substr string
+	min, max       dollars
+	hasMin, hasMax bool
+	sortBy         string // "name" 或 "price"
+	desc           bool
+	limit          int
+	after          *listCursor // nil 表示从头开始
+}
+
+// listCursor 是编码进 cursor 参数里的内容
+type listCursor struct {
+	Sort  string  `json:"s"`
+	Desc  bool    `json:"d"`
+	Name  string  `json:"n"`
+	Price dollars `json:"p"`
+}
+
+func (c listCursor) encode() string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// parseListQuery 解析并校验查询参数
+func parseListQuery(v url.Values) (*listQuery, error) {
+	q := &listQuery{
+		prefix: v.Get("prefix"),
+		substr: v.Get("q"),
+		sortBy: "name",
+		limit:  defaultListLimit,
+	}
+
+	var err error
+	if s := v.Get("min"); s != "" {
+		if q.min, err = parsePrice(s); err != nil {
+			return nil, fmt.Errorf("invalid min: %q", s)
+		}
+		q.hasMin = true
+	}
+	if s := v.Get("max"); s != "" {
+		if q.max, err = parsePrice(s); err != nil {
+			return nil, fmt.Errorf("invalid max: %q", s)
+		}
+		q.hasMax = true
+	}
+
+	switch s := v.Get("sort"); s {
+	case "", "name":
+	case "price":
+		q.sortBy = "price"
+	default:
+		return nil, fmt.Errorf("invalid sort: %q (want name or price)", s)
+	}
+	switch s := v.Get("order"); s {
+	case "", "asc":
+	case "desc":
+		q.desc = true
+	default:
+		return nil, fmt.Errorf("invalid order: %q (want asc or desc)", s)
+	}
+
+	if s := v.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 || n > maxListLimit {
+			return nil, fmt.Errorf("invalid limit: %q (want 1..%d)", s, maxListLimit)
+		}
+		q.limit = n
+	}
+
+	if s := v.Get("cursor"); s != "" {
+		var c listCursor
+		b, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil || json.Unmarshal(b, &c) != nil {
+			return nil, fmt.Errorf("invalid cursor")
+		}
+		// 游标只能配合生成它时的排序方式使用
+		if c.Sort != q.sortBy || c.Desc != q.desc {
+			return nil, fmt.Errorf("cursor does not match sort=%s order", q.sortBy)
+		}
+		q.after = &c
+	}
+	return q, nil
+}
+
+// parsePrice 解析一个非负价格
+func parsePrice(s string) (dollars, error) {
+	price, err := strconv.ParseFloat(s, 32)
+	if err != nil {
+		return 0, err
+	}
+	if price < 0 {
+		return 0, fmt.Errorf("negative price")
+	}
+	return dollars(price), nil
+}
+
+// less 按查询的排序方式比较两条记录
+func (q *listQuery) less(a, b listItem) bool {
+	if q.desc {
+		a, b = b, a
+	}
+	if q.sortBy == "price" && a.Price != b.Price {
+		return a.Price < b.Price
+	}
+	return a.Name < b.Name
+}
+
+func (q *listQuery) match(it listItem) bool {
+	if q.prefix != "" && !strings.HasPrefix(it.Name, q.prefix) {
+		return false
+	}
+	if q.substr != "" && !strings.Contains(it.Name, q.substr) {
+		return false
+	}
+	if q.hasMin && it.Price < q.min {
+		return false
+	}
+	if q.hasMax && it.Price > q.max {
+		return false
+	}
+	return true
+}
+
+// run 对 store 执行查询，返回这一页的记录和下一页的游标（没有下一页时为空）
+func (q *listQuery) run(store map[string]dollars) (page []listItem, next string) {
+	var items []listItem
+	for name, price := range store {
+		if it := (listItem{name, price}); q.match(it) {
+			items = append(items, it)
+		}
+	}
+	sort.Slice(items, func(i, j int) bool { return q.less(items[i], items[j]) })
+
+	// 跳过游标之前（含游标本身）的记录
+	if q.after != nil {
+		last := listItem{q.after.Name, q.after.Price}
+		i := sort.Search(len(items), func(i int) bool { return q.less(last, items[i]) })
+		items = items[i:]
+	}
+
+	if len(items) > q.limit {
+		items = items[:q.limit]
+		last := items[len(items)-1]
+		next = listCursor{q.sortBy, q.desc, last.Name, last.Price}.encode()
+	}
+	return items, next
+}
@@ -1,11 +1,17 @@
 package main
 
 import (
+	"errors"
+	"flag"
 	"fmt"
+	"io/fs"
 	"log"
+	"log/slog"
 	"net/http"
+	"os"
 	"strconv"
 	"sync"
+	"time"
 )
 
 // --- 1. 基础定义 ---
@@ -18,20 +24,51 @@ func (d dollars) String() string { return fmt.Sprintf("$%.2f", d) }
 // 我们不再直接把 database 定义为 map，而是定义为一个结构体
 // 这样可以把 map 和 保护它的锁(Mutex) 绑在一起
 type database struct {
-	store map[string]dollars // 真正存数据的地方
-	mu    sync.Mutex         // 互斥锁，用来保护 store
+	store   map[string]dollars // 真正存数据的地方
+	history []change           // 所有变更事件，按时间顺序追加（见 history.go）
+	changed chan struct{}      // 每来一条新事件就关闭并替换，用来唤醒 /events 的订阅者
+	epoch   string             // 这份历史的随机标识，进程重启或从库重新同步后就换了（见 replica.go）
+
+	stock        map[string]int          // 可售库存（已扣除预留），见 stock.go
+	reservations map[string]*reservation // 未完成的预留，按预留号索引
+
+	mu sync.Mutex // 互斥锁，保护上面所有字段
 }
 
 // --- 3. CRUD 处理函数 ---
 
 // [R] List: 列出所有商品
+// URL: /list 或 /list?at=2026-01-01T00:00:00Z （查看某一时刻的商品目录）
+// 过滤、排序和分页参数见 list.go，下一页的游标放在响应头 X-Next-Cursor 里
 func (db *database) list(w http.ResponseWriter, req *http.Request) {
+	q, err := parseListQuery(req.URL.Query())
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest) // 400
+		fmt.Fprintf(w, "%v\n", err)
+		return
+	}
+
 	// 凡是涉及读写 map，都要先加锁
 	db.mu.Lock()
 	defer db.mu.Unlock() // 函数结束时自动解锁
 
-	for item, price := range db.store {
-		fmt.Fprintf(w, "%s: %s\n", item, price)
+	store := db.store
+	if at := req.URL.Query().Get("at"); at != "" {
+		t, err := time.Parse(time.RFC3339, at)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest) // 400
+			fmt.Fprintf(w, "invalid time: %q\n", at)
+			return
+		}
+		store = db.snapshotAt(t)
+	}
+
+	page, next := q.run(store)
+	if next != "" {
+		w.Header().Set("X-Next-Cursor", next)
+	}
+	for _, it := range page {
+		fmt.Fprintf(w, "%s: %s\n", it.Name, it.Price)
 	}
 }
 
@@ -52,10 +89,11 @@ func (db *database) price(w http.ResponseWriter, req *http.Request) {
 }
 
 // [C] Create: 创建新商品
-// URL: /create?item=hat&price=20
+// URL: /create?item=hat&price=20 （可选 stock=10 设置初始库存）
 func (db *database) create(w http.ResponseWriter, req *http.Request) {
 	item := req.URL.Query().Get("item")
 	priceStr := req.URL.Query().Get("price")
+	stockStr := req.URL.Query().Get("stock")
 
 	// 简单的参数校验
 	if item == "" || priceStr == "" {
@@ -71,6 +109,16 @@ func (db *database) create(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	stock := 0
+	if stockStr != "" {
+		stock, err = strconv.Atoi(stockStr)
+		if err != nil || stock < 0 {
+			w.WriteHeader(http.StatusBadRequest) // 400
+			fmt.Fprint(w, "invalid stock\n")
+			return
+		}
+	}
+
 	db.mu.Lock()
 	defer db.mu.Unlock()
 
@@ -82,6 +130,10 @@ func (db *database) create(w http.ResponseWriter, req *http.Request) {
 	}
 
 	db.store[item] = dollars(price)
+	db.record("create", item, 0, dollars(price))
+	if stock > 0 {
+		db.setStock(item, stock)
+	}
 	fmt.Fprintf(w, "created %s: %s\n", item, dollars(price))
 }
 
@@ -102,13 +154,15 @@ func (db *database) update(w http.ResponseWriter, req *http.Request) {
 	defer db.mu.Unlock()
 
 	// 检查是否存在
-	if _, ok := db.store[item]; !ok {
+	old, ok := db.store[item]
+	if !ok {
 		w.WriteHeader(http.StatusNotFound) // 404
 		fmt.Fprintf(w, "no such item: %q\n", item)
 		return
 	}
 
 	db.store[item] = dollars(price)
+	db.record("update", item, old, dollars(price))
 	fmt.Fprintf(w, "updated %s: %s\n", item, dollars(price))
 }
 
@@ -120,31 +174,97 @@ func (db *database) delete(w http.ResponseWriter, req *http.Request) {
 	db.mu.Lock()
 	defer db.mu.Unlock()
 
-	if _, ok := db.store[item]; !ok {
+	old, ok := db.store[item]
+	if !ok {
 		w.WriteHeader(http.StatusNotFound)
 		fmt.Fprintf(w, "no such item: %q\n", item)
 		return
 	}
 
 	delete(db.store, item)
+	db.forgetStock(item)
+	db.record("delete", item, old, 0)
 	fmt.Fprintf(w, "deleted %s\n", item)
 }
 
 // --- 4. 主程序 ---
 
 func main() {
-	// 初始化结构体
-	db := &database{
-		store: map[string]dollars{"shoes": 50, "socks": 5},
+	// 解析命令行参数
+	// 比如: go run . -tokens=tokens.txt -open-read
+	// 从库: go run . -addr localhost:9000 -rpc localhost:9001 -follow http://localhost:8000 -leader-token <令牌>
+	addr := flag.String("addr", "localhost:8000", "HTTP listen address")
+	tokensFile := flag.String("tokens", "tokens.txt", "API token file, one \"<token> <ro|rw>\" per line")
+	openRead := flag.Bool("open-read", false, "allow read-only endpoints (/list, /price, /stock, /history, /events, /metrics, /replication) without a token")
+	rpcAddr := flag.String("rpc", "localhost:8001", "JSON-RPC listen address (empty to disable)")
+	follow := flag.String("follow", "", "run as a read-only follower of the leader at this URL")
+	leaderToken := flag.String("leader-token", "", "token for reading the leader's /events (follower only)")
+	flag.Parse()
+
+	// 所有日志（包括标准库 log 打出来的）都走 JSON 格式的 slog
+	logger := slog.New(slog.NewJSONHandler(os.Stderr, nil))
+	slog.SetDefault(logger)
+
+	// 开了 -open-read 时没有令牌文件也能跑起来（比如刚 checkout 下来），只是写接口谁都用不了
+	tokens, err := loadTokens(*tokensFile)
+	switch {
+	case errors.Is(err, fs.ErrNotExist) && *openRead:
+		slog.Warn("token file not found, write endpoints are disabled", "path", *tokensFile)
+	case err != nil:
+		log.Fatalf("load tokens: %v (create the file, or run with -open-read for read-only access)", err)
+	}
+	auth := &authenticator{tokens: tokens, openRead: *openRead}
+	m := newMetrics(logger)
+
+	// 初始化结构体（初始数据也会记入变更历史）
+	// 从库从空库开始，所有数据都从主库的事件流里来
+	var db *database
+	var rep *replica
+	if *follow == "" {
+		db = newDatabase(map[string]dollars{"shoes": 50, "socks": 5})
+	} else {
+		db = newDatabase(nil)
+		rep = newReplica(*follow, *leaderToken, db)
 	}
 
-	// 注册路由
-	http.HandleFunc("/list", db.list)
-	http.HandleFunc("/price", db.price)
-	http.HandleFunc("/create", db.create)
-	http.HandleFunc("/update", db.update)
-	http.HandleFunc("/delete", db.delete)
+	// 注册路由：外层统计指标，内层鉴权
+	// 读接口要求 ro 及以上，写接口要求 rw；从库上的写接口直接重定向到主库
+	handle := func(route string, need role, h http.HandlerFunc) {
+		if need == roleWrite && rep != nil {
+			http.HandleFunc(route, m.instrument(route, rep.redirect))
+			return
+		}
+		http.HandleFunc(route, m.instrument(route, auth.require(need, h)))
+	}
+	handle("/list", roleRead, db.list)
+	handle("/price", roleRead, db.price)
+	handle("/history", roleRead, db.historyOf)
+	handle("/events", roleRead, db.events)
+	handle("/metrics", roleRead, m.serve)
+	handle("/create", roleWrite, db.create)
+	handle("/update", roleWrite, db.update)
+	handle("/delete", roleWrite, db.delete)
+	handle("/batch", roleWrite, db.batch)
+	handle("/stock", roleRead, db.stockOf)
+	handle("/restock", roleWrite, db.restock)
+	handle("/reserve", roleWrite, db.reserve)
+	handle("/checkout", roleWrite, db.checkout)
+	handle("/release", roleWrite, db.release)
+
+	if rep != nil {
+		handle("/replication", roleRead, rep.status)
+		go rep.run()
+	} else {
+		handle("/replication", roleRead, db.leaderStatus)
+		// 后台清理过期的预留（从库没有预留，库存数字直接跟主库走）
+		go db.expireLoop()
+	}
+
+	// JSON-RPC 接口跑在另一个端口上，和 HTTP 共用同一个 db
+	if *rpcAddr != "" {
+		go func() { log.Fatal(serveRPC(*rpcAddr, db, auth, *follow)) }()
+	}
 
-	fmt.Println("服务器运行在 http://localhost:8000")
-	log.Fatal(http.ListenAndServe("localhost:8000", nil))
+	slog.Info("服务器运行在 http://" + *addr)
+	log.Fatal(http.ListenAndServe(*addr, nil))
 }
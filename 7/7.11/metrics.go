@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// --- 请求指标与结构化日志 ---
+// 每个请求结束时：按 (路由, 状态码) 计数、把耗时记进直方图、用 slog 打一行日志。
+// /metrics 以 Prometheus 文本格式输出这些数据。
+
+// 直方图的桶上界（秒），和 Prometheus 客户端库的默认值一致
+var latencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type routeCode struct {
+	route string
+	code  int
+}
+
+type histogram struct {
+	counts []uint64 // counts[i] 是耗时 <= latencyBuckets[i] 的请求数（已累加）
+	sum    float64
+	count  uint64
+}
+
+func (h *histogram) observe(v float64) {
+	for i, le := range latencyBuckets {
+		if v <= le {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+type metrics struct {
+	mu       sync.Mutex
+	requests map[routeCode]uint64
+	latency  map[string]*histogram
+	logger   *slog.Logger
+}
+
+func newMetrics(logger *slog.Logger) *metrics {
+	return &metrics{
+		requests: make(map[routeCode]uint64),
+		latency:  make(map[string]*histogram),
+		logger:   logger,
+	}
+}
+
+// statusRecorder 记下处理函数写出的状态码和字节数
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	if r.status == 0 {
+		r.status = code
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += n
+	return n, err
+}
+
+// Unwrap 让 http.ResponseController 能找到底层的 Flush / SetWriteDeadline（/events 要用）
+func (r *statusRecorder) Unwrap() http.ResponseWriter { return r.ResponseWriter }
+
+// instrument 是指标中间件，route 用注册时的路径，避免查询参数撑爆标签
+func (m *metrics) instrument(route string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		h(rec, req)
+		elapsed := time.Since(start)
+		if rec.status == 0 {
+			rec.status = http.StatusOK // 什么都没写，net/http 会回 200
+		}
+
+		m.mu.Lock()
+		m.requests[routeCode{route, rec.status}]++
+		hist, ok := m.latency[route]
+		if !ok {
+			hist = &histogram{counts: make([]uint64, len(latencyBuckets))}
+			m.latency[route] = hist
+		}
+		hist.observe(elapsed.Seconds())
+		m.mu.Unlock()
+
+		m.logger.Info("request",
+			"method", req.Method,
+			"route", route,
+			"path", req.URL.RequestURI(),
+			"status", rec.status,
+			"bytes", rec.bytes,
+			"duration_ms", float64(elapsed.Microseconds())/1000,
+			"remote", req.RemoteAddr,
+		)
+	}
+}
+
+// [R] Metrics: Prometheus 文本格式的指标
+func (m *metrics) serve(w http.ResponseWriter, req *http.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	// map 遍历顺序随机，排序后输出保证每次抓取格式一致
+	keys := make([]routeCode, 0, len(m.requests))
+	for k := range m.requests {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].route != keys[j].route {
+			return keys[i].route < keys[j].route
+		}
+		return keys[i].code < keys[j].code
+	})
+	fmt.Fprintln(w, "# HELP inventory_http_requests_total Total HTTP requests by route and status code.")
+	fmt.Fprintln(w, "# TYPE inventory_http_requests_total counter")
+	for _, k := range keys {
+		fmt.Fprintf(w, "inventory_http_requests_total{route=%q,code=\"%d\"} %d\n", k.route, k.code, m.requests[k])
+	}
+
+	routes := make([]string, 0, len(m.latency))
+	for r := range m.latency {
+		routes = append(routes, r)
+	}
+	sort.Strings(routes)
+	fmt.Fprintln(w, "# HELP inventory_http_request_duration_seconds HTTP request latency by route.")
+	fmt.Fprintln(w, "# TYPE inventory_http_request_duration_seconds histogram")
+	for _, r := range routes {
+		h := m.latency[r]
+		for i, le := range latencyBuckets {
+			fmt.Fprintf(w, "inventory_http_request_duration_seconds_bucket{route=%q,le=%q} %d\n",
+				r, strconv.FormatFloat(le, 'g', -1, 64), h.counts[i])
+		}
+		fmt.Fprintf(w, "inventory_http_request_duration_seconds_bucket{route=%q,le=\"+Inf\"} %d\n", r, h.count)
+		fmt.Fprintf(w, "inventory_http_request_duration_seconds_sum{route=%q} %g\n", r, h.sum)
+		fmt.Fprintf(w, "inventory_http_request_duration_seconds_count{route=%q} %d\n", r, h.count)
+	}
+}
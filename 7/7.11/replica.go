@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --- 主从复制 ---
+// 用 -follow http://leader:8000 启动的实例是只读从库:
+//   - 订阅主库的 /events，把事件原样（保留序号和时间）应用到自己的 database；
+//   - /list、/price、/history 等读接口用本地数据回答；
+//   - 写接口一律 307 重定向到主库；
+//   - /replication 报告复制进度和延迟。
+//
+// 主库重启后序号从头开始，从库通过 /events 的 X-History-Epoch 响应头发现这一点，
+// 清空本地数据重新全量同步。
+//
+// 本地试验只需要两个进程:
+//
+//	go run . -addr localhost:8000 -rpc localhost:8001
+//	go run . -addr localhost:9000 -rpc localhost:9001 -follow http://localhost:8000 -leader-token <ro 令牌>
+
+const (
+	replicaMinBackoff = 1 * time.Second
+	replicaMaxBackoff = 30 * time.Second
+	// 主库每 eventsHeartbeat 至少发一次心跳，超过三次没收到任何数据就认为连接已经死了
+	replicaIdleTimeout = 3 * eventsHeartbeat
+)
+
+// errLeaderRestarted 表示主库的历史重新开始了（通常是主库重启），本地数据要全部重来
+var errLeaderRestarted = errors.New("leader history restarted")
+
+type replica struct {
+	leader string // 主库地址，例如 http://localhost:8000
+	token  string // 访问主库 /events 用的令牌
+	db     *database
+	client *http.Client
+
+	mu          sync.Mutex // 保护下面的状态字段
+	connected   bool
+	epoch       string    // 本地数据来自主库的哪一份历史，为空表示还没连上过
+	head        int64     // 最近一次得知的主库最新序号
+	lastContact time.Time // 最近一次收到主库数据的时间
+	caughtUp    time.Time // 最近一次追平主库的时间，为零表示还从来没追平过
+	lastErr     string
+}
+
+func newReplica(leader, token string, db *database) *replica {
+	return &replica{
+		leader: strings.TrimRight(leader, "/"),
+		token:  token,
+		db:     db,
+		client: &http.Client{}, // 长连接，不能设总超时，由 replicaIdleTimeout 兜底
+	}
+}
+
+// run 一直保持与主库的连接，断开后按指数退避重连
+func (r *replica) run() {
+	backoff := replicaMinBackoff
+	for {
+		start := time.Now()
+		err := r.stream()
+
+		resync := errors.Is(err, errLeaderRestarted)
+		r.mu.Lock()
+		r.connected = false
+		r.lastErr = err.Error()
+		if resync {
+			// 旧主库的序号已经没有意义了
+			r.epoch, r.head, r.caughtUp = "", 0, time.Time{}
+		}
+		r.mu.Unlock()
+
+		if resync {
+			slog.Warn("replica: resyncing from scratch", "leader", r.leader, "err", err)
+			r.db.reset()
+			continue
+		}
+		// 连接稳定跑过一阵子的话，重连从最小间隔开始
+		if time.Since(start) > replicaMaxBackoff {
+			backoff = replicaMinBackoff
+		}
+		slog.Warn("replica: stream ended", "leader", r.leader, "err", err, "retry_in", backoff.String())
+		time.Sleep(backoff)
+		backoff = min(backoff*2, replicaMaxBackoff)
+	}
+}
+
+// stream 从本地最新序号开始订阅主库的事件流，直到出错
+func (r *replica) stream() error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// 看门狗：长时间收不到任何数据（连心跳都没有）就断开重连
+	watchdog := time.AfterFunc(replicaIdleTimeout, cancel)
+	defer watchdog.Stop()
+
+	since := r.db.head()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet,
+		r.leader+"/events?since="+strconv.FormatInt(since, 10), nil)
+	if err != nil {
+		return err
+	}
+	if r.token != "" {
+		req.Header.Set("Authorization", "Bearer "+r.token)
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("leader returned %s", resp.Status)
+	}
+
+	// 必须在应用任何事件之前比对：主库换了历史的话，since 之后的事件和本地数据对不上
+	epoch := resp.Header.Get("X-History-Epoch")
+	r.mu.Lock()
+	if r.epoch != "" && epoch != r.epoch {
+		r.mu.Unlock()
+		return fmt.Errorf("%w: epoch %q, was %q", errLeaderRestarted, epoch, r.epoch)
+	}
+	r.epoch = epoch
+	r.connected = true
+	r.lastErr = ""
+	r.mu.Unlock()
+	slog.Info("replica: connected", "leader", r.leader, "since", since)
+
+	// 按 SSE 格式逐行解析：data 行累积，空行表示一个事件结束
+	var data strings.Builder
+	input := bufio.NewScanner(resp.Body)
+	input.Buffer(make([]byte, 64*1024), 1<<20)
+	for input.Scan() {
+		watchdog.Reset(replicaIdleTimeout)
+		line := input.Text()
+
+		switch {
+		case line == "":
+			if data.Len() == 0 {
+				continue
+			}
+			var c change
+			if err := json.Unmarshal([]byte(data.String()), &c); err != nil {
+				return fmt.Errorf("bad event from leader: %v", err)
+			}
+			data.Reset()
+			if err := r.db.applyReplicated(c); err != nil {
+				return err
+			}
+			r.touch(c.ID)
+		case strings.HasPrefix(line, ": head "):
+			head, err := strconv.ParseInt(strings.TrimPrefix(line, ": head "), 10, 64)
+			if err != nil {
+				continue
+			}
+			if head < r.db.head() {
+				// 不发 X-History-Epoch 的主库只能靠这个发现它重启过
+				return fmt.Errorf("%w: leader at %d, follower at %d", errLeaderRestarted, head, r.db.head())
+			}
+			r.touch(head)
+		case strings.HasPrefix(line, "data:"):
+			data.WriteString(strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " "))
+		}
+		// id: 和 event: 行的内容在 data 里都有，不需要单独处理
+	}
+	if err := input.Err(); err != nil {
+		return err
+	}
+	return errors.New("leader closed the stream")
+}
+
+// touch 记录一次与主库的通信，head 是主库至少已经达到的序号
+func (r *replica) touch(head int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	r.lastContact = now
+	if head > r.head {
+		r.head = head
+	}
+	if r.db.head() >= r.head {
+		r.caughtUp = now
+	}
+}
+
+// [R] Replication: 复制状态
+// lag_seconds 是距离上一次追平主库过去了多久，追平时为 0，还从来没追平过时为 unknown
+func (r *replica) status(w http.ResponseWriter, req *http.Request) {
+	applied := r.db.head()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	behind := max(r.head-applied, 0)
+	lag := "0.000"
+	switch {
+	case r.caughtUp.IsZero():
+		lag = "unknown" // 没有追平过，没有可以比较的时间点
+	case behind > 0 || !r.connected:
+		lag = fmt.Sprintf("%.3f", time.Since(r.caughtUp).Seconds())
+	}
+	fmt.Fprintf(w, "role: follower\n")
+	fmt.Fprintf(w, "leader: %s\n", r.leader)
+	fmt.Fprintf(w, "connected: %t\n", r.connected)
+	fmt.Fprintf(w, "applied: %d\n", applied)
+	fmt.Fprintf(w, "leader_head: %d\n", r.head)
+	fmt.Fprintf(w, "behind: %d\n", behind)
+	fmt.Fprintf(w, "lag_seconds: %s\n", lag)
+	if !r.lastContact.IsZero() {
+		fmt.Fprintf(w, "last_contact: %s\n", r.lastContact.UTC().Format(time.RFC3339))
+	}
+	if r.lastErr != "" {
+		fmt.Fprintf(w, "last_error: %s\n", r.lastErr)
+	}
+}
+
+// redirect 代替从库上的所有写接口，把请求原样转到主库
+// 307 会让客户端保持原来的方法和请求体（/batch 的 POST 也能跟过去）
+func (r *replica) redirect(w http.ResponseWriter, req *http.Request) {
+	http.Redirect(w, req, r.leader+req.URL.RequestURI(), http.StatusTemporaryRedirect)
+}
+
+// [R] Replication: 主库上的复制状态，只报告最新序号
+func (db *database) leaderStatus(w http.ResponseWriter, req *http.Request) {
+	fmt.Fprintf(w, "role: leader\n")
+	fmt.Fprintf(w, "head: %d\n", db.head())
+}
+
+// head 返回本地最新的事件序号
+func (db *database) head() int64 {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return int64(len(db.history))
+}
+
+// applyReplicated 把主库的一条事件应用到本地
+// 重复的事件直接忽略；序号跳号说明漏了事件，返回错误让调用者重新订阅
+func (db *database) applyReplicated(c change) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	want := int64(len(db.history)) + 1
+	if c.ID < want {
+		return nil
+	}
+	if c.ID > want {
+		return fmt.Errorf("replication gap: want event %d, got %d", want, c.ID)
+	}
+
+	switch c.Op {
+	case "create", "update":
+		db.store[c.Item] = c.Price
+	case "delete":
+		delete(db.store, c.Item)
+		db.forgetStock(c.Item)
+	case "stock":
+		if c.Stock == nil {
+			return fmt.Errorf("replication: stock event %d without stock", c.ID)
+		}
+		db.stock[c.Item] = *c.Stock
+	default:
+		return fmt.Errorf("replication: unknown op %q in event %d", c.Op, c.ID)
+	}
+	db.publish(c)
+	return nil
+}
+
+// reset 清空本地数据，从库重新全量同步前调用
+func (db *database) reset() {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.store = make(map[string]dollars)
+	db.stock = make(map[string]int)
+	db.reservations = make(map[string]*reservation)
+	db.history = nil
+	db.epoch = rand.Text()
+	close(db.changed)
+	db.changed = make(chan struct{})
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"sort"
+	"strings"
+
+	"github.com/C7107/go_projects/7/7.11/invrpc"
+)
+
+// --- JSON-RPC 接口 ---
+// 在单独的端口上用 net/rpc + jsonrpc 编码提供和 HTTP 一样的增删改查，
+// 和 HTTP 处理函数共用同一个 database（同一把 db.mu），令牌规则也一样。
+// 客户端见 invrpc 包。
+
+// inventoryRPC 的导出方法就是 RPC 方法，签名必须是 func(args *T1, reply *T2) error
+type inventoryRPC struct {
+	db     *database
+	auth   *authenticator
+	leader string // 非空表示本实例是从库，写操作要去这个主库
+}
+
+// check 校验令牌权限，规则和 HTTP 的 require 中间件一致
+// 从库上的写操作直接拒绝，并在错误里告诉客户端主库地址
+func (s *inventoryRPC) check(method, token string, need role) error {
+	if need == roleWrite && s.leader != "" {
+		return fmt.Errorf("%w: send %s to the leader at %s", invrpc.ErrReadOnly, method, s.leader)
+	}
+	if need == roleRead && s.auth.openRead {
+		return nil
+	}
+	got := s.auth.lookup(token)
+	if got == 0 {
+		slog.Warn("rpc auth denied", "method", method, "reason", "invalid token")
+		return invrpc.ErrUnauthorized
+	}
+	if got < need {
+		slog.Warn("rpc auth denied", "method", method, "reason", "role "+got.String())
+		return fmt.Errorf("%w: role %s cannot call %s", invrpc.ErrForbidden, got, method)
+	}
+	return nil
+}
+
+// item 组装返回给客户端的商品
+// 注意：调用者必须已经持有 db.mu
+func (s *inventoryRPC) item(name string) invrpc.Item {
+	return invrpc.Item{Name: name, Price: float64(s.db.store[name]), Stock: s.db.stock[name]}
+}
+
+func (s *inventoryRPC) List(args *invrpc.ListArgs, reply *invrpc.ListReply) error {
+	if err := s.check("List", args.Token, roleRead); err != nil {
+		return err
+	}
+
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	reply.Items = nil
+	for name := range s.db.store {
+		if strings.HasPrefix(name, args.Prefix) {
+			reply.Items = append(reply.Items, s.item(name))
+		}
+	}
+	sort.Slice(reply.Items, func(i, j int) bool { return reply.Items[i].Name < reply.Items[j].Name })
+	return nil
+}
+
+func (s *inventoryRPC) Get(args *invrpc.ItemArgs, reply *invrpc.Item) error {
+	if err := s.check("Get", args.Token, roleRead); err != nil {
+		return err
+	}
+
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	if _, ok := s.db.store[args.Name]; !ok {
+		return fmt.Errorf("%w: %q", invrpc.ErrNotFound, args.Name)
+	}
+	*reply = s.item(args.Name)
+	return nil
+}
+
+func (s *inventoryRPC) Create(args *invrpc.ItemArgs, reply *invrpc.Item) error {
+	if err := s.check("Create", args.Token, roleWrite); err != nil {
+		return err
+	}
+	if args.Name == "" || args.Price < 0 || args.Stock < 0 {
+		return fmt.Errorf("%w: name is required, price and stock must not be negative", invrpc.ErrInvalid)
+	}
+
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	if _, ok := s.db.store[args.Name]; ok {
+		return fmt.Errorf("%w: %q", invrpc.ErrExists, args.Name)
+	}
+	price := dollars(args.Price)
+	s.db.store[args.Name] = price
+	s.db.record("create", args.Name, 0, price)
+	if args.Stock > 0 {
+		s.db.setStock(args.Name, args.Stock)
+	}
+	*reply = s.item(args.Name)
+	return nil
+}
+
+func (s *inventoryRPC) Update(args *invrpc.ItemArgs, reply *invrpc.Item) error {
+	if err := s.check("Update", args.Token, roleWrite); err != nil {
+		return err
+	}
+	if args.Price < 0 {
+		return fmt.Errorf("%w: negative price", invrpc.ErrInvalid)
+	}
+
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	old, ok := s.db.store[args.Name]
+	if !ok {
+		return fmt.Errorf("%w: %q", invrpc.ErrNotFound, args.Name)
+	}
+	price := dollars(args.Price)
+	s.db.store[args.Name] = price
+	s.db.record("update", args.Name, old, price)
+	*reply = s.item(args.Name)
+	return nil
+}
+
+func (s *inventoryRPC) Delete(args *invrpc.ItemArgs, reply *invrpc.Item) error {
+	if err := s.check("Delete", args.Token, roleWrite); err != nil {
+		return err
+	}
+
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	old, ok := s.db.store[args.Name]
+	if !ok {
+		return fmt.Errorf("%w: %q", invrpc.ErrNotFound, args.Name)
+	}
+	*reply = s.item(args.Name)
+	delete(s.db.store, args.Name)
+	s.db.forgetStock(args.Name)
+	s.db.record("delete", args.Name, old, 0)
+	return nil
+}
+
+// serveRPC 在 addr 上接受 JSON-RPC 连接，每个连接一个 goroutine
+// leader 非空表示本实例是从库
+func serveRPC(addr string, db *database, auth *authenticator, leader string) error {
+	srv := rpc.NewServer()
+	if err := srv.RegisterName(invrpc.ServiceName, &inventoryRPC{db: db, auth: auth, leader: leader}); err != nil {
+		return err
+	}
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	slog.Info("JSON-RPC 服务运行在 " + addr)
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			slog.Error("rpc accept", "err", err)
+			continue
+		}
+		go srv.ServeCodec(jsonrpc.NewServerCodec(conn))
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// --- 库存与预留 ---
+// db.stock 里存的是“可售”数量，也就是已经扣掉了未完成预留的数量。
+// 下单流程分两步:
+//
+//	/reserve?item=hat&qty=2    预留：立刻从可售库存里扣掉，返回预留号
+//	/checkout?id=<预留号>      结账：预留转成真正的售出
+//	/release?id=<预留号>       放弃：把数量还回库存
+//
+// 超过有效期还没结账的预留会被后台 goroutine 自动放回库存。
+// 所有库存变化都在 db.mu 里完成，所以不可能超卖。
+
+const (
+	defaultReserveTTL = 15 * time.Minute
+	maxReserveTTL     = 24 * time.Hour
+	expireInterval    = 5 * time.Second // 后台清理过期预留的间隔
+)
+
+type reservation struct {
+	ID      string
+	Item    string
+	Qty     int
+	Expires time.Time
+}
+
+func (r *reservation) String() string {
+	return fmt.Sprintf("%s: %d x %s, expires %s", r.ID, r.Qty, r.Item, r.Expires.Format(time.RFC3339))
+}
+
+// setStock 修改可售库存并记一条 stock 事件
+// 注意：调用者必须已经持有 db.mu
+func (db *database) setStock(item string, n int) {
+	db.stock[item] = n
+	db.appendChange(change{Op: "stock", Item: item, Stock: &n})
+}
+
+// forgetStock 在删除商品时清掉它的库存和所有未完成的预留
+// 注意：调用者必须已经持有 db.mu
+func (db *database) forgetStock(item string) {
+	delete(db.stock, item)
+	for id, r := range db.reservations {
+		if r.Item == item {
+			delete(db.reservations, id)
+		}
+	}
+}
+
+// expire 把 now 之前到期的预留放回库存
+func (db *database) expire(now time.Time) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	for id, r := range db.reservations {
+		if now.After(r.Expires) {
+			delete(db.reservations, id)
+			db.setStock(r.Item, db.stock[r.Item]+r.Qty)
+		}
+	}
+}
+
+// expireLoop 定期清理过期预留，在 main 里用 go 启动
+func (db *database) expireLoop() {
+	for now := range time.Tick(expireInterval) {
+		db.expire(now)
+	}
+}
+
+// parseQty 解析一个正整数数量
+func parseQty(s string) (int, error) {
+	n, err := strconv.Atoi(s)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid qty: %q", s)
+	}
+	return n, nil
+}
+
+func newReservationID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// [R] Stock: 查询库存
+// URL: /stock?item=hat
+func (db *database) stockOf(w http.ResponseWriter, req *http.Request) {
+	item := req.URL.Query().Get("item")
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if _, ok := db.store[item]; !ok {
+		w.WriteHeader(http.StatusNotFound) // 404
+		fmt.Fprintf(w, "no such item: %q\n", item)
+		return
+	}
+	reserved := 0
+	for _, r := range db.reservations {
+		if r.Item == item {
+			reserved += r.Qty
+		}
+	}
+	fmt.Fprintf(w, "%s: %d available, %d reserved\n", item, db.stock[item], reserved)
+}
+
+// [U] Restock: 补货
+// URL: /restock?item=hat&qty=10
+func (db *database) restock(w http.ResponseWriter, req *http.Request) {
+	item := req.URL.Query().Get("item")
+	qty, err := parseQty(req.URL.Query().Get("qty"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest) // 400
+		fmt.Fprintf(w, "%v\n", err)
+		return
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if _, ok := db.store[item]; !ok {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "no such item: %q\n", item)
+		return
+	}
+	db.setStock(item, db.stock[item]+qty)
+	fmt.Fprintf(w, "restocked %s: %d available\n", item, db.stock[item])
+}
+
+// [U] Reserve: 预留库存
+// URL: /reserve?item=hat&qty=2 （可选 ttl=10m，默认 15 分钟）
+func (db *database) reserve(w http.ResponseWriter, req *http.Request) {
+	item := req.URL.Query().Get("item")
+	qty, err := parseQty(req.URL.Query().Get("qty"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "%v\n", err)
+		return
+	}
+	ttl := defaultReserveTTL
+	if s := req.URL.Query().Get("ttl"); s != "" {
+		ttl, err = time.ParseDuration(s)
+		if err != nil || ttl <= 0 || ttl > maxReserveTTL {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "invalid ttl: %q\n", s)
+			return
+		}
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if _, ok := db.store[item]; !ok {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "no such item: %q\n", item)
+		return
+	}
+	if avail := db.stock[item]; avail < qty {
+		w.WriteHeader(http.StatusConflict) // 409
+		fmt.Fprintf(w, "insufficient stock for %s: %d available, %d requested\n", item, avail, qty)
+		return
+	}
+
+	r := &reservation{
+		ID:      newReservationID(),
+		Item:    item,
+		Qty:     qty,
+		Expires: time.Now().Add(ttl).UTC(),
+	}
+	db.reservations[r.ID] = r
+	db.setStock(item, db.stock[item]-qty)
+	fmt.Fprintf(w, "reserved %s\n", r)
+}
+
+// takeReservation 取出并删除一个仍然有效的预留，找不到就写好错误响应返回 nil
+// 注意：调用者必须已经持有 db.mu
+func (db *database) takeReservation(w http.ResponseWriter, id string) *reservation {
+	r, ok := db.reservations[id]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "no such reservation: %q\n", id)
+		return nil
+	}
+	delete(db.reservations, id)
+	if time.Now().After(r.Expires) {
+		// 已经过期但后台还没来得及清理：顺手放回库存
+		db.setStock(r.Item, db.stock[r.Item]+r.Qty)
+		w.WriteHeader(http.StatusGone) // 410
+		fmt.Fprintf(w, "reservation %s expired\n", id)
+		return nil
+	}
+	return r
+}
+
+// [U] Checkout: 结账，预留转为售出
+// URL: /checkout?id=<预留号>
+func (db *database) checkout(w http.ResponseWriter, req *http.Request) {
+	id := req.URL.Query().Get("id")
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	r := db.takeReservation(w, id)
+	if r == nil {
+		return
+	}
+	// 库存在预留时已经扣过了，这里只需要删掉预留
+	fmt.Fprintf(w, "checked out %s: %d x %s\n", r.ID, r.Qty, r.Item)
+}
+
+// [U] Release: 放弃预留，数量还回库存
+// URL: /release?id=<预留号>
+func (db *database) release(w http.ResponseWriter, req *http.Request) {
+	id := req.URL.Query().Get("id")
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	r := db.takeReservation(w, id)
+	if r == nil {
+		return
+	}
+	db.setStock(r.Item, db.stock[r.Item]+r.Qty)
+	fmt.Fprintf(w, "released %s: %d x %s\n", r.ID, r.Qty, r.Item)
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bufio"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// --- 注册与登录 ---
+// 昵称默认先到先得。用 /register <密码> 可以把当前昵称注册下来，之后:
+//   - 别人登记或 /nick 成这个昵称时必须先输入密码；
+//   - 已经在线的用户可以用 /login <昵称> <密码> 切换过去。
+//
+// 账号存放在 -users 文件里，每行一个:
+//
+//	昵称 盐(hex) 迭代次数 PBKDF2-SHA256(hex)
+//
+// 同一个 IP 连续输错 -login-attempts 次密码，就要等 -login-lockout 才能再试。
+// 密码是明文发过来的，公网上请配上 -tls-cert/-tls-key（见 main.go）。
+// 算哈希很慢，所以校验都在各自连接的 Goroutine 里做，不经过 broadcaster。
+
+var (
+	usersPath     = flag.String("users", "chat-users.txt", "file holding registered nicknames and password hashes (empty disables accounts)")
+	loginAttempts = flag.Int("login-attempts", 5, "failed password attempts allowed per IP before a lockout")
+	loginLockout  = flag.Duration("login-lockout", 5*time.Minute, "how long an IP is locked out after too many failed logins")
+	tlsCert       = flag.String("tls-cert", "", "TLS certificate file; with -tls-key, serve TCP and HTTP over TLS")
+	tlsKey        = flag.String("tls-key", "", "TLS private key file")
+)
+
+const (
+	pbkdf2Iterations = 600000 // OWASP 对 PBKDF2-HMAC-SHA256 的建议值
+	saltSize         = 16
+	minPasswordLen   = 6
+)
+
+// users 是全局的账号表，nil 表示没有开启账号功能
+var users *accountStore
+
+type account struct {
+	salt       []byte
+	iterations int
+	hash       []byte
+}
+
+// failure 记录一个 IP 最近连续输错密码的情况
+type failure struct {
+	count int
+	until time.Time // 锁定到这个时间，零值表示没被锁
+}
+
+// accountStore 是账号表和登录失败计数，可以被多个连接的 Goroutine 同时使用
+type accountStore struct {
+	path string
+
+	mu       sync.Mutex
+	accounts map[string]account
+	failures map[string]*failure // IP -> 连续失败
+}
+
+// loadAccounts 读入账号文件，文件不存在时从空表开始
+func loadAccounts(path string) (*accountStore, error) {
+	s := &accountStore{path: path, accounts: make(map[string]account), failures: make(map[string]*failure)}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	input := bufio.NewScanner(f)
+	for n := 1; input.Scan(); n++ {
+		fields := strings.Fields(input.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		a, err := parseAccount(fields)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, n, err)
+		}
+		s.accounts[fields[0]] = a
+	}
+	if err := input.Err(); err != nil {
+		return nil, err
+	}
+	log.Printf("读入 %d 个注册用户", len(s.accounts))
+	return s, nil
+}
+
+func parseAccount(fields []string) (account, error) {
+	if len(fields) != 4 {
+		return account{}, errors.New("want: name salt iterations hash")
+	}
+	salt, err1 := hex.DecodeString(fields[1])
+	iterations, err2 := strconv.Atoi(fields[2])
+	hash, err3 := hex.DecodeString(fields[3])
+	if err := errors.Join(err1, err2, err3); err != nil {
+		return account{}, err
+	}
+	return account{salt, iterations, hash}, nil
+}
+
+// registered 判断昵称是否已经被注册，s 为 nil 时总是 false
+func (s *accountStore) registered(name string) bool {
+	if s == nil {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.accounts[name]
+	return ok
+}
+
+// register 注册一个新账号并追加到文件
+func (s *accountStore) register(name, password string) error {
+	if utf8.RuneCountInString(password) < minPasswordLen {
+		return fmt.Errorf("密码至少要 %d 个字符", minPasswordLen)
+	}
+	salt := make([]byte, saltSize)
+	rand.Read(salt)
+	hash, err := pbkdf2.Key(sha256.New, password, salt, pbkdf2Iterations, sha256.Size)
+	if err != nil {
+		return err
+	}
+	a := account{salt, pbkdf2Iterations, hash}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.accounts[name]; ok {
+		return fmt.Errorf("昵称 %s 已经注册过了", name)
+	}
+	f, err := os.OpenFile(s.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		log.Printf("写账号文件失败: %v", err)
+		return errors.New("注册失败，请稍后再试")
+	}
+	_, err = fmt.Fprintf(f, "%s %x %d %x\n", name, a.salt, a.iterations, a.hash)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		log.Printf("写账号文件失败: %v", err)
+		return errors.New("注册失败，请稍后再试")
+	}
+	s.accounts[name] = a
+	return nil
+}
+
+// login 校验密码；ip 是客户端地址，用来限制连续失败的次数
+func (s *accountStore) login(ip, name, password string) error {
+	s.mu.Lock()
+	a, ok := s.accounts[name]
+	f := s.failures[ip]
+	if f != nil && time.Now().Before(f.until) {
+		s.mu.Unlock()
+		return fmt.Errorf("密码错误次数太多，请 %s 后再试", time.Until(f.until).Round(time.Second))
+	}
+	s.mu.Unlock()
+
+	// 算哈希不持锁；没有这个账号时也照样算一遍，不让人从响应时间猜出哪些昵称注册过
+	if !ok {
+		a = account{make([]byte, saltSize), pbkdf2Iterations, nil}
+	}
+	hash, err := pbkdf2.Key(sha256.New, password, a.salt, a.iterations, sha256.Size)
+	if err == nil && ok && subtle.ConstantTimeCompare(hash, a.hash) == 1 {
+		s.mu.Lock()
+		delete(s.failures, ip)
+		s.mu.Unlock()
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f = s.failures[ip]
+	if f == nil || (!f.until.IsZero() && time.Now().After(f.until)) {
+		f = &failure{}
+		s.failures[ip] = f
+	}
+	f.count++
+	if f.count >= *loginAttempts {
+		f.until = time.Now().Add(*loginLockout)
+		log.Printf("%s 连续 %d 次登录失败，锁定 %s", ip, f.count, *loginLockout)
+		return fmt.Errorf("密码错误次数太多，请 %s 后再试", *loginLockout)
+	}
+	return errors.New("昵称或密码错误")
+}
+
+// remoteIP 取出连接对端的 IP，用作登录失败计数的键
+func remoteIP(conn net.Conn) string {
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return conn.RemoteAddr().String()
+	}
+	return host
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"runtime/debug"
+	"strings"
+)
+
+// --- 机器人 ---
+// 机器人是编译进服务器的插件，启动时按 -bots 注册。每个机器人:
+//   - 有自己的昵称（和用户共用名字空间，用户不能再用这个昵称）；
+//   - 能看到所有房间里的发言和进出，以及别人发给它的私信；
+//   - 通过 Replier 回复到消息所在的房间，或者私信某人。
+//
+// 每个机器人跑在自己的 Goroutine 里，broadcaster 只是把消息非阻塞地放进它的收件箱（botInbox 条）；
+// 收件箱满了说明这个机器人太慢，消息直接丢掉，绝不会拖慢聊天室。
+// 机器人发回的话经 botReplies 交给 broadcaster，再像普通发言一样广播、记录。
+// 机器人看不到机器人自己（包括别的机器人）说的话，免得互相接话停不下来。
+
+var botsFlag = flag.String("bots", "timebot,calcbot", "comma-separated built-in bots to start (timebot, calcbot, alertbot)")
+
+const botInbox = 64
+
+// Bot 是机器人插件的接口
+type Bot interface {
+	// Name 是机器人在聊天室里的昵称
+	Name() string
+	// Handle 处理一条消息，在机器人自己的 Goroutine 里按顺序调用，可以慢慢来
+	Handle(m message, reply Replier)
+}
+
+// Replier 把机器人的话送回聊天室
+type Replier struct {
+	bot  string
+	room string // 消息所在的房间；私信时为空
+	from string // 消息的发送者
+}
+
+// Say 回复到消息所在的房间；消息是私信的话就私信回给发送者
+func (r Replier) Say(text string) {
+	if r.room == "" {
+		r.Tell(r.from, text)
+		return
+	}
+	botReplies <- botReply{bot: r.bot, room: r.room, text: text}
+}
+
+// Tell 私信给 to
+func (r Replier) Tell(to, text string) {
+	botReplies <- botReply{bot: r.bot, to: to, text: text}
+}
+
+// botReply 是机器人要说的一句话，to 不为空表示私信
+type botReply struct {
+	bot, room, to, text string
+}
+
+var botReplies = make(chan botReply)
+
+// botRunner 是一个正在运行的机器人
+type botRunner struct {
+	bot     Bot
+	inbox   chan message
+	dropped int // 因为收件箱满而丢掉的消息数，只由 broadcaster 读写
+}
+
+func startBot(b Bot) *botRunner {
+	r := &botRunner{bot: b, inbox: make(chan message, botInbox)}
+	go r.run()
+	return r
+}
+
+func (r *botRunner) run() {
+	for m := range r.inbox {
+		r.handle(m)
+	}
+}
+
+// handle 调用插件，插件 panic 时只记日志，不影响后面的消息
+func (r *botRunner) handle(m message) {
+	defer func() {
+		if p := recover(); p != nil {
+			log.Printf("机器人 %s 处理消息时 panic: %v\n%s", r.bot.Name(), p, debug.Stack())
+		}
+	}()
+	r.bot.Handle(m, Replier{bot: r.bot.Name(), room: m.Room, from: m.From})
+}
+
+// offer 非阻塞地把消息放进收件箱，只能由 broadcaster 调用
+func (r *botRunner) offer(m message) {
+	select {
+	case r.inbox <- m:
+	default:
+		r.dropped++
+		if r.dropped%100 == 1 {
+			log.Printf("机器人 %s 太慢，已丢弃 %d 条消息", r.bot.Name(), r.dropped)
+		}
+	}
+}
+
+// newBots 按 -bots 创建并启动机器人
+func newBots(names string) map[string]*botRunner {
+	bots := make(map[string]*botRunner)
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		factory, ok := builtinBots[name]
+		if !ok {
+			log.Fatalf("未知的机器人: %s", name)
+		}
+		b := factory()
+		bots[b.Name()] = startBot(b)
+		log.Printf("机器人 %s 已启动", b.Name())
+	}
+	return bots
+}
+
+// feedBots 把一条房间消息（或者发给某个机器人的私信）交给机器人，只能由 broadcaster 调用
+func (h *hub) feedBots(m message) {
+	if _, fromBot := h.bots[m.From]; fromBot {
+		return
+	}
+	if m.Type == "private" {
+		if r, ok := h.bots[m.To]; ok {
+			r.offer(m)
+		}
+		return
+	}
+	for _, r := range h.bots {
+		r.offer(m)
+	}
+}
+
+// botSay 执行机器人的回复，只能由 broadcaster 调用
+func (h *hub) botSay(r botReply) {
+	if r.to != "" {
+		if to, ok := h.clients[r.to]; ok {
+			to.deliver(private(r.bot, r.to, r.text, false))
+		}
+		return
+	}
+	if _, ok := h.rooms[r.room]; ok { // 房间已经没人了就不说了
+		h.say(r.room, r.bot, r.text)
+	}
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"math/rand/v2"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 压测工具：模拟成千上万个 TCP 客户端同时连上聊天服务器，按固定速率发言，
+// 统计每条发言从发出到被各个房间成员收到的延迟分布，以及丢了多少条。
+//
+//	go run ./chat -rate 0 -bots "" -transcript "" &   # 服务器关掉限流，否则压测流量会被当成刷屏
+//	go run ./chat-bench -clients 2000 -rooms 20 -rate 0.5 -duration 30s
+//
+// 每条发言的内容是 "bench:<发出时的 UnixNano>:xxx…"，收到的人用自己的时钟减一下就是延迟，
+// 所以压测工具和服务器最好跑在同一台机器上（或者时钟同步得很好的机器上）。
+// 应该收到的条数 = 每个房间发出的条数 × 房间里的人数（发言的人自己也会收到），
+// 差额就是被服务器的慢客户端保护丢掉（或者因为被踢而没收到）的。
+// 几千个连接要先调大打开文件数的上限，例如 ulimit -n 65536。
+
+var (
+	addr     = flag.String("addr", "localhost:8000", "chat server address")
+	clients  = flag.Int("clients", 1000, "number of simulated clients")
+	rooms    = flag.Int("rooms", 1, "spread the clients over this many rooms (1 keeps everyone in #lobby)")
+	rate     = flag.Float64("rate", 0.2, "messages per second each client sends")
+	duration = flag.Duration("duration", 30*time.Second, "how long to send messages")
+	drain    = flag.Duration("drain", 3*time.Second, "how long to keep reading after sending stops")
+	size     = flag.Int("size", 64, "approximate length of each message in bytes")
+	useJSON  = flag.Bool("json", false, "talk JSON Lines instead of plain text (exercises the server's JSON encoder)")
+	dialers  = flag.Int("dialers", 50, "connections opened in parallel while ramping up")
+)
+
+const marker = "bench:"
+
+// runID 让每次压测的昵称都不一样，上一次的连接还没被服务器清理掉也不会撞名
+var runID = rand.N(1000)
+
+// stats 是所有模拟客户端共用的计数器
+type stats struct {
+	sent         []atomic.Int64 // 每个房间发出的条数
+	members      []atomic.Int64 // 每个房间里的人数
+	received     atomic.Int64
+	disconnected atomic.Int64 // 压测期间被服务器断开的连接
+	start        atomic.Int64 // 开始计时的 UnixNano，之前发的（包括加入房间时回放的旧消息）不算
+	latency      histogram
+}
+
+// bot 是一个模拟客户端
+type bot struct {
+	id    int
+	room  int
+	conn  net.Conn
+	w     *bufio.Writer
+	input *bufio.Scanner
+}
+
+func main() {
+	flag.Parse()
+	if *clients < 1 || *rooms < 1 || *rooms > *clients || *rate <= 0 {
+		log.Fatal("-clients、-rooms、-rate 必须大于 0，且 -rooms 不能多于 -clients")
+	}
+	st := &stats{sent: make([]atomic.Int64, *rooms), members: make([]atomic.Int64, *rooms)}
+	st.start.Store(math.MaxInt64)
+
+	// 1. 建立连接：同时最多 -dialers 个在握手，免得把服务器的 Accept 队列挤爆
+	// 登记成功的马上开始读，否则别人加入房间的通知会把服务器那边它的队列挤满
+	log.Printf("正在建立 %d 个连接 ...", *clients)
+	begin := time.Now()
+	bots := make([]*bot, *clients)
+	stop := make(chan struct{})
+	var wg, readers sync.WaitGroup
+	sem := make(chan struct{}, *dialers)
+	var failed atomic.Int64
+	for i := range bots {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			b, err := connect(i, i%*rooms)
+			if err != nil {
+				if failed.Add(1) <= 10 {
+					log.Printf("客户端 %d: %v", i, err)
+				}
+				return
+			}
+			bots[i] = b
+			st.members[b.room].Add(1)
+			readers.Add(1)
+			go func() {
+				defer readers.Done()
+				b.read(st, stop)
+			}()
+		}()
+	}
+	wg.Wait()
+	connected := *clients - int(failed.Load())
+	log.Printf("%d 个连接建立完毕，用时 %s，失败 %d 个", connected, time.Since(begin).Round(time.Millisecond), failed.Load())
+	if connected == 0 {
+		return
+	}
+
+	// 2. 加入房间引起的通知要等它们发完，所以先等一会儿再开始计时
+	time.Sleep(time.Second)
+
+	// 3. 压测：每个客户端按 -rate 发言，起始时间随机错开
+	log.Printf("开始压测: %d 个房间，每个客户端每秒 %g 条，持续 %s", *rooms, *rate, *duration)
+	start := time.Now()
+	st.start.Store(start.UnixNano())
+	end := start.Add(*duration)
+	var senders sync.WaitGroup
+	for _, b := range bots {
+		if b != nil {
+			senders.Add(1)
+			go func() {
+				defer senders.Done()
+				b.send(st, end)
+			}()
+		}
+	}
+	senders.Wait()
+	elapsed := time.Since(start)
+	time.Sleep(*drain)
+	close(stop)
+	for _, b := range bots {
+		if b != nil {
+			b.conn.Close()
+		}
+	}
+	readers.Wait()
+
+	report(st, connected, elapsed)
+}
+
+// connect 连上服务器，登记昵称 bench<runID>-<id>，需要的话换到压测房间
+func connect(id, room int) (*bot, error) {
+	conn, err := net.DialTimeout("tcp", *addr, 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	b := &bot{id: id, room: room, conn: conn, w: bufio.NewWriter(conn)}
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+	if *useJSON {
+		b.w.WriteString("/proto json\n")
+	}
+	nick := fmt.Sprintf("bench%d-%d", runID, id)
+	b.w.WriteString(nick + "\n")
+	if *rooms > 1 {
+		b.w.WriteString("/join #bench-" + strconv.Itoa(room) + "\n/part #lobby\n")
+	}
+	if err := b.w.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	// 登记之前服务器只会发提示和错误，收到别的任何一行都说明已经登记成功了。
+	// 不能只等欢迎语：很多人同时加入房间时，服务器可能把它和一堆加入通知一起丢掉
+	input := bufio.NewScanner(conn)
+	input.Buffer(make([]byte, 64*1024), 1<<20)
+	for input.Scan() {
+		line := input.Text()
+		switch {
+		case strings.Contains(line, "请输入昵称") || strings.Contains(line, "协议切换为"):
+		case strings.Contains(line, "已被占用") || strings.Contains(line, "封禁") || strings.Contains(line, "昵称"):
+			conn.Close()
+			return nil, fmt.Errorf("登记失败: %s", line)
+		default:
+			conn.SetDeadline(time.Time{})
+			b.input = input
+			return b, nil
+		}
+	}
+	conn.Close()
+	if input.Err() != nil {
+		return nil, input.Err()
+	}
+	return nil, fmt.Errorf("服务器在登记完成前断开了连接")
+}
+
+// send 按 -rate 发言直到 end
+func (b *bot) send(st *stats, end time.Time) {
+	interval := time.Duration(float64(time.Second) / *rate)
+	pad := strings.Repeat("x", max(0, *size-len(marker)-20))
+	next := time.Now().Add(rand.N(interval))
+	for {
+		time.Sleep(time.Until(next))
+		now := time.Now()
+		if now.After(end) {
+			return
+		}
+		text := marker + strconv.FormatInt(now.UnixNano(), 10) + ":" + pad
+		if *useJSON {
+			text = `{"text":"` + text + `"}`
+		}
+		b.conn.SetWriteDeadline(now.Add(5 * time.Second))
+		if _, err := b.w.WriteString(text + "\n"); err != nil {
+			return
+		}
+		if err := b.w.Flush(); err != nil {
+			return
+		}
+		st.sent[b.room].Add(1)
+		next = next.Add(interval)
+	}
+}
+
+// read 读服务器发来的每一行，遇到计时开始之后的压测发言就记下延迟
+func (b *bot) read(st *stats, stop <-chan struct{}) {
+	for b.input.Scan() {
+		line := b.input.Text()
+		i := strings.Index(line, marker)
+		if i < 0 {
+			continue
+		}
+		ts, _, _ := strings.Cut(line[i+len(marker):], ":")
+		ns, err := strconv.ParseInt(ts, 10, 64)
+		if err != nil || ns < st.start.Load() {
+			continue
+		}
+		st.received.Add(1)
+		st.latency.record(time.Since(time.Unix(0, ns)))
+	}
+	select {
+	case <-stop:
+	default:
+		st.disconnected.Add(1) // 还没结束就断了，说明被服务器踢掉了
+	}
+}
+
+// report 打印压测结果
+func report(st *stats, connected int, elapsed time.Duration) {
+	var sent, expected int64
+	for i := range st.sent {
+		n := st.sent[i].Load()
+		sent += n
+		expected += n * st.members[i].Load()
+	}
+	received := st.received.Load()
+	dropped := expected - received
+
+	fmt.Printf("客户端        %d（%d 个房间），被服务器断开 %d 个\n", connected, *rooms, st.disconnected.Load())
+	fmt.Printf("发出          %d 条（%.0f 条/秒）\n", sent, float64(sent)/elapsed.Seconds())
+	fmt.Printf("应收          %d 条\n", expected)
+	fmt.Printf("实收          %d 条（%.0f 条/秒）\n", received, float64(received)/elapsed.Seconds())
+	if expected > 0 {
+		fmt.Printf("丢失          %d 条（%.2f%%）\n", dropped, 100*float64(dropped)/float64(expected))
+	}
+	if received > 0 {
+		h := &st.latency
+		fmt.Printf("延迟          p50 %s  p90 %s  p99 %s  p99.9 %s  最大 %s\n",
+			h.percentile(50), h.percentile(90), h.percentile(99), h.percentile(99.9),
+			time.Duration(h.max.Load()).Round(time.Microsecond))
+	}
+}
+
+// --- 延迟直方图 ---
+// 按微秒取对数分桶，每个桶宽约 6%，几百万个样本也只占几 KB，可以多个 Goroutine 同时记录
+
+const bucketsPerE = 16 // 每增长 e 倍分多少个桶
+
+type histogram struct {
+	buckets [400]atomic.Int64
+	count   atomic.Int64
+	max     atomic.Int64 // 纳秒
+}
+
+func (h *histogram) record(d time.Duration) {
+	us := max(d.Microseconds(), 0)
+	i := min(int(math.Log1p(float64(us))*bucketsPerE), len(h.buckets)-1)
+	h.buckets[i].Add(1)
+	h.count.Add(1)
+	for {
+		m := h.max.Load()
+		if int64(d) <= m || h.max.CompareAndSwap(m, int64(d)) {
+			return
+		}
+	}
+}
+
+// percentile 返回第 p 百分位所在桶的上界
+func (h *histogram) percentile(p float64) time.Duration {
+	rank := int64(math.Ceil(float64(h.count.Load()) * p / 100))
+	var seen int64
+	for i := range h.buckets {
+		seen += h.buckets[i].Load()
+		if seen >= rank {
+			us := math.Expm1(float64(i+1) / bucketsPerE)
+			return (time.Duration(us) * time.Microsecond).Round(time.Microsecond)
+		}
+	}
+	return time.Duration(h.max.Load())
+}
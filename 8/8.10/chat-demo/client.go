@@ -1,31 +1,376 @@
 package main
 
 import (
-	"io"
+	"bufio"
+	"crypto/tls"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"hash/fnv"
 	"log"
+	"maps"
 	"net"
 	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
 )
 
+// 聊天客户端：用 JSON Lines 协议（见服务器的 protocol.go）和服务器说话。
+//   - 断线后按指数退避自动重连，重连后自动用原来的昵称登记，并回到原来的房间；
+//   - 离线期间输入的内容先攒着，连上之后按顺序补发；
+//     已经发出去但还没收到 ack 的行也会重新排队（极少数情况下可能重复一条）；
+//   - /quit 和 /help 在本地处理，不发给服务器；
+//   - 服务器发来的文字去掉控制字符再显示，别人没法用 ANSI 转义序列搞乱终端。
+
+var (
+	addr     = flag.String("addr", "localhost:8000", "chat server address")
+	nickFlag = flag.String("nick", "", "nickname to register with (asked interactively when empty)")
+	useTLS   = flag.Bool("tls", false, "connect with TLS")
+	noColor  = flag.Bool("no-color", os.Getenv("NO_COLOR") != "", "disable colored output")
+)
+
+const (
+	minBackoff = 1 * time.Second
+	maxBackoff = 30 * time.Second
+	maxPending = 200 // 离线时最多攒这么多行，再多就丢掉最旧的
+
+	defaultRoom = "#lobby" // 服务器登记后自动加入的房间
+)
+
+// message 和服务器 protocol.go 里的同名类型对应
+type message struct {
+	ID      int64     `json:"id"`
+	Time    time.Time `json:"time"`
+	Type    string    `json:"type"`
+	Room    string    `json:"room"`
+	From    string    `json:"from"`
+	To      string    `json:"to"`
+	Text    string    `json:"text"`
+	Ref     string    `json:"ref"`
+	History bool      `json:"history"`
+}
+
+// line 是用户输入的一行，id 用来和服务器的 ack 对上
+type line struct {
+	id   string
+	text string
+}
+
+// client 保存跨越多次连接的状态，只在 main 的 Goroutine 里使用
+type client struct {
+	nick    string          // 当前昵称，重连时用它自动登记；为空表示还不知道
+	rooms   map[string]bool // 加入的房间，重连后重新加入；为 nil 表示还没登记过
+	current string          // 当前房间
+	nextID  int
+	pending []line // 还没发出去的行
+	unacked []line // 发出去了但还没收到 ack 的行
+}
+
 func main() {
-	// 连接服务器
-	conn, err := net.Dial("tcp", "localhost:8000")
-	if err != nil {
-		log.Fatal(err)
-	}
-	defer conn.Close()
+	flag.Parse()
+	c := &client{nick: *nickFlag}
 
-	// 启动一个 goroutine 专门负责：从服务器读数据 -> 显示到屏幕
+	stdin := make(chan string)
 	go func() {
-		// io.Copy 会一直把 conn 的数据拷贝到 Stdout，直到连接断开
-		io.Copy(os.Stdout, conn)
-		log.Println("连接已断开")
-		os.Exit(0)
+		input := bufio.NewScanner(os.Stdin)
+		for input.Scan() {
+			stdin <- input.Text()
+		}
+		close(stdin)
 	}()
 
-	// 主程序负责：从键盘读数据 -> 发送给服务器
-	// io.Copy 会一直把 Stdin 的数据拷贝到 conn
-	if _, err := io.Copy(conn, os.Stdin); err != nil {
-		log.Fatal(err)
+	backoff := minBackoff
+	for {
+		conn, err := dial()
+		if err != nil {
+			status("连接 %s 失败: %v，%s 后重试", *addr, err, backoff)
+			if !c.wait(stdin, backoff) {
+				return
+			}
+			backoff = min(backoff*2, maxBackoff)
+			continue
+		}
+		status("已连接 %s", *addr)
+		welcomed, quit := c.session(conn, stdin)
+		conn.Close()
+		if quit {
+			return
+		}
+		if welcomed {
+			backoff = minBackoff // 成功登记过，说明服务器是好的，重连从最短间隔开始
+		}
+		status("连接已断开，%s 后重连（期间输入的内容会在重连后发出）", backoff)
+		if !c.wait(stdin, backoff) {
+			return
+		}
+		backoff = min(backoff*2, maxBackoff)
+	}
+}
+
+func dial() (net.Conn, error) {
+	d := &net.Dialer{Timeout: 10 * time.Second}
+	if *useTLS {
+		return tls.DialWithDialer(d, "tcp", *addr, nil)
 	}
+	return d.Dial("tcp", *addr)
+}
+
+// wait 在离线时等待 d，期间的输入先攒起来；用户要退出时返回 false
+func (c *client) wait(stdin <-chan string, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+			return true
+		case text, ok := <-stdin:
+			if !ok {
+				return false
+			}
+			l, send, quit := c.input(text)
+			if quit {
+				return false
+			}
+			if send {
+				c.queue(l)
+			}
+		}
+	}
+}
+
+// input 处理用户输入的一行：本地命令就地执行，其他的编上号返回，send 表示要发给服务器
+func (c *client) input(text string) (l line, send, quit bool) {
+	switch strings.TrimSpace(text) {
+	case "/quit":
+		return line{}, false, true
+	case "/help":
+		fmt.Println("本地命令: /quit 退出  /help 显示本帮助  /commands 查看服务器支持的命令")
+		return line{}, false, false
+	case "/commands":
+		text = "/help"
+	}
+	c.nextID++
+	return line{strconv.Itoa(c.nextID), text}, true, false
+}
+
+// queue 把一行放进待发队列
+func (c *client) queue(l line) {
+	c.pending = append(c.pending, l)
+	if len(c.pending) > maxPending {
+		c.pending = c.pending[1:]
+		status("离线输入太多，丢掉了最早的一行")
+	}
+}
+
+// session 处理一次连接，直到连接断开或用户退出
+// welcomed 表示这次连接成功登记过昵称
+func (c *client) session(conn net.Conn, stdin <-chan string) (welcomed, quit bool) {
+	incoming := make(chan message)
+	go read(conn, incoming)
+
+	send := func(l line) {
+		b, _ := json.Marshal(map[string]string{"id": l.id, "text": l.text})
+		fmt.Fprintf(conn, "%s\n", b)
+		if l.id != "" {
+			c.unacked = append(c.unacked, l)
+		}
+	}
+	flush := func() {
+		for _, l := range c.pending {
+			send(l)
+		}
+		c.pending = nil
+	}
+
+	// 登记成功之前，攒着的内容不能发，否则会被当成昵称；
+	// 但服务器要我们手动输入（第一次连接不知道昵称、昵称被占用、要密码）时，新输入的行直接发
+	interactive := c.nick == ""
+	switched, prompts := false, 0
+	fmt.Fprintln(conn, "/proto json")
+	if c.nick != "" {
+		send(line{text: c.nick}) // 自动登记，不要 ack，免得断线后被当成聊天内容补发
+	}
+
+	for {
+		select {
+		case m, ok := <-incoming:
+			if !ok {
+				// 没收到 ack 的行排回队首，下次连上再发
+				c.pending = append(c.unacked, c.pending...)
+				c.unacked = nil
+				return welcomed, false
+			}
+			switch m.Type {
+			case "ping":
+				fmt.Fprintln(conn, "PONG"+strings.TrimPrefix(m.Text, "PING"))
+				continue
+			case "ack":
+				c.acked(m.Ref)
+				continue
+			case "welcome":
+				c.nick = m.To
+				welcomed = true
+				c.rejoin(send) // 先回到原来的房间，补发的内容才会发到对的地方
+				flush()
+			case "nick":
+				if m.From == c.nick {
+					c.nick = m.To
+				}
+			case "join":
+				if m.From == c.nick && !m.History {
+					c.rooms[m.Room] = true
+					c.current = m.Room
+				}
+			case "leave":
+				if m.From == c.nick && !m.History {
+					delete(c.rooms, m.Room)
+					if c.current == m.Room {
+						c.current = ""
+					}
+				}
+			case "system":
+				// 登记过程中的提示、当前房间的切换都没有专门的消息类型，只能从文字里认
+				if room, ok := strings.CutPrefix(m.Text, "当前房间切换到 "); ok {
+					c.current = room
+				}
+				if m.Text == "协议切换为 json" {
+					switched = true
+					continue
+				}
+				if m.Text == "请输入昵称:" {
+					if !switched {
+						continue // 切换协议前的提示，切换后服务器还会再问一次
+					}
+					prompts++
+					interactive = interactive || prompts > 1 // 自动登记失败了
+				} else if strings.HasSuffix(m.Text, "请输入密码:") {
+					interactive = true
+				}
+			}
+			if s := render(m); s != "" {
+				fmt.Println(s)
+			}
+
+		case text, ok := <-stdin:
+			if !ok {
+				return welcomed, true
+			}
+			l, ok, quit := c.input(text)
+			switch {
+			case quit:
+				return welcomed, true
+			case !ok:
+			case welcomed:
+				c.queue(l)
+				flush()
+			case interactive:
+				send(line{text: l.text}) // 正在手动输入昵称或密码，不要 ack，断线后也不补发
+			default:
+				c.queue(l)
+			}
+		}
+	}
+}
+
+// rejoin 在登记成功后回到上次连接时的房间，当前房间放在最后加入，这样它还是当前房间
+// 房间记录先清空，由服务器发回来的 join 消息（包括自动加入的默认房间）重新建立
+func (c *client) rejoin(send func(line)) {
+	rooms, current := c.rooms, c.current
+	c.rooms, c.current = make(map[string]bool), ""
+	if rooms == nil {
+		return // 第一次登记
+	}
+	for _, room := range slices.Sorted(maps.Keys(rooms)) {
+		if room != current {
+			send(line{text: "/join " + room}) // 不要 ack，断线后也不补发
+		}
+	}
+	if current != "" {
+		send(line{text: "/join " + current})
+	}
+	if !rooms[defaultRoom] {
+		send(line{text: "/part " + defaultRoom}) // 服务器总是先把人放进默认房间
+	}
+}
+
+// acked 把收到 ack 的行从 unacked 里删掉（ack 是按顺序来的，一般就是第一个）
+func (c *client) acked(ref string) {
+	for i, l := range c.unacked {
+		if l.id == ref {
+			c.unacked = append(c.unacked[:i], c.unacked[i+1:]...)
+			return
+		}
+	}
+}
+
+// read 把服务器发来的每一行解析成 message 发到 out，连接断开时关闭 out
+func read(conn net.Conn, out chan<- message) {
+	defer close(out)
+	input := bufio.NewScanner(conn)
+	input.Buffer(make([]byte, 64*1024), 1<<20)
+	for input.Scan() {
+		var m message
+		if err := json.Unmarshal(input.Bytes(), &m); err != nil {
+			// 切换协议之前的那一行是纯文本
+			m = message{Time: time.Now(), Type: "system", Text: input.Text()}
+		}
+		out <- m
+	}
+}
+
+// render 把一条消息排成一行给人看；时间用本地时区，昵称按名字上色
+func render(m message) string {
+	m.Room, m.From, m.To, m.Text = clean(m.Room), clean(m.From), clean(m.To), clean(m.Text)
+	ts := m.Time.Local().Format("15:04:05")
+	if m.History {
+		ts = m.Time.Local().Format("01-02 15:04") // 回放的旧消息带上日期
+	}
+	ts = paint(ts, 90) // 灰色
+	switch m.Type {
+	case "chat":
+		return fmt.Sprintf("%s %s <%s> %s", ts, m.Room, nick(m.From), m.Text)
+	case "join", "leave":
+		return fmt.Sprintf("%s %s %s", ts, m.Room, paint("-- "+m.Text, 90))
+	case "private":
+		return fmt.Sprintf("%s %s %s", ts, paint("*"+m.From+" -> "+m.To+"*", 35), m.Text)
+	default:
+		return fmt.Sprintf("%s %s", ts, paint("-- "+m.Text, 33))
+	}
+}
+
+// clean 去掉控制字符（包括 ESC），制表符换成空格
+func clean(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r == '\t':
+			return ' '
+		case unicode.IsControl(r):
+			return -1
+		}
+		return r
+	}, s)
+}
+
+// nickColors 是昵称可用的前景色（ANSI），同一个昵称总是同一种颜色
+var nickColors = []int{31, 32, 34, 35, 36, 91, 92, 94, 95, 96}
+
+func nick(name string) string {
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	return paint(name, nickColors[h.Sum32()%uint32(len(nickColors))])
+}
+
+func paint(s string, color int) string {
+	if *noColor {
+		return s
+	}
+	return fmt.Sprintf("\x1b[%dm%s\x1b[0m", color, s)
+}
+
+// status 显示客户端自己的状态提示
+func status(format string, args ...any) {
+	log.Printf(format, args...)
 }
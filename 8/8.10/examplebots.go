@@ -0,0 +1,191 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// --- 内置的几个机器人 ---
+//
+//	timebot   !time [时区]       报时，例如 !time Asia/Shanghai
+//	calcbot   !calc <表达式>     四则运算，支持 + - * / % 和括号
+//	alertbot  有人提到 -alert-words 里的关键词时，私信通知 -alert-to 里的人
+
+var (
+	alertWords = flag.String("alert-words", "", "comma-separated keywords alertbot watches for (case-insensitive)")
+	alertTo    = flag.String("alert-to", "", "comma-separated nicknames alertbot notifies")
+)
+
+// builtinBots 是 -bots 可以用的机器人
+var builtinBots = map[string]func() Bot{
+	"timebot":  func() Bot { return timeBot{} },
+	"calcbot":  func() Bot { return calcBot{} },
+	"alertbot": newAlertBot,
+}
+
+// botCommand 取出 "!name 参数" 形式的机器人命令的参数，不是这条命令时返回 false
+func botCommand(m message, name string) (string, bool) {
+	if m.Type != "chat" && m.Type != "private" {
+		return "", false
+	}
+	cmd, arg, _ := strings.Cut(strings.TrimSpace(m.Text), " ")
+	if cmd != name {
+		return "", false
+	}
+	return strings.TrimSpace(arg), true
+}
+
+// ---- timebot ----
+
+type timeBot struct{}
+
+func (timeBot) Name() string { return "timebot" }
+
+func (timeBot) Handle(m message, reply Replier) {
+	arg, ok := botCommand(m, "!time")
+	if !ok {
+		return
+	}
+	loc := time.Local
+	if arg != "" {
+		var err error
+		if loc, err = time.LoadLocation(arg); err != nil {
+			reply.Say("不认识的时区: " + arg)
+			return
+		}
+	}
+	reply.Say(time.Now().In(loc).Format("2006-01-02 15:04:05 MST"))
+}
+
+// ---- calcbot ----
+
+type calcBot struct{}
+
+func (calcBot) Name() string { return "calcbot" }
+
+func (calcBot) Handle(m message, reply Replier) {
+	expr, ok := botCommand(m, "!calc")
+	if !ok {
+		return
+	}
+	if expr == "" || len(expr) > 200 {
+		reply.Say("用法: !calc <表达式>，例如 !calc (1+2)*3")
+		return
+	}
+	v, err := calc(expr)
+	if err != nil {
+		reply.Say("算不了: " + err.Error())
+		return
+	}
+	reply.Say(expr + " = " + strconv.FormatFloat(v, 'g', -1, 64))
+}
+
+// calc 借用 Go 的表达式语法解析，只接受数字、四则运算、取余和括号
+func calc(expr string) (float64, error) {
+	e, err := parser.ParseExpr(expr)
+	if err != nil {
+		return 0, errors.New("表达式写错了")
+	}
+	return eval(e)
+}
+
+func eval(e ast.Expr) (float64, error) {
+	switch e := e.(type) {
+	case *ast.BasicLit:
+		if e.Kind != token.INT && e.Kind != token.FLOAT {
+			return 0, fmt.Errorf("不支持 %s", e.Value)
+		}
+		return strconv.ParseFloat(e.Value, 64)
+	case *ast.ParenExpr:
+		return eval(e.X)
+	case *ast.UnaryExpr:
+		x, err := eval(e.X)
+		if err != nil {
+			return 0, err
+		}
+		switch e.Op {
+		case token.ADD:
+			return x, nil
+		case token.SUB:
+			return -x, nil
+		}
+	case *ast.BinaryExpr:
+		x, err := eval(e.X)
+		if err != nil {
+			return 0, err
+		}
+		y, err := eval(e.Y)
+		if err != nil {
+			return 0, err
+		}
+		switch e.Op {
+		case token.ADD:
+			return x + y, nil
+		case token.SUB:
+			return x - y, nil
+		case token.MUL:
+			return x * y, nil
+		case token.QUO:
+			if y == 0 {
+				return 0, errors.New("除数为 0")
+			}
+			return x / y, nil
+		case token.REM:
+			if y == 0 {
+				return 0, errors.New("除数为 0")
+			}
+			return math.Mod(x, y), nil
+		}
+		return 0, fmt.Errorf("不支持运算符 %s", e.Op)
+	}
+	return 0, errors.New("只支持数字、+ - * / % 和括号")
+}
+
+// ---- alertbot ----
+
+type alertBot struct {
+	words []string // 已经转成小写
+	to    []string
+}
+
+func newAlertBot() Bot {
+	b := &alertBot{}
+	for _, w := range strings.Split(*alertWords, ",") {
+		if w = strings.TrimSpace(w); w != "" {
+			b.words = append(b.words, strings.ToLower(w))
+		}
+	}
+	for _, name := range strings.Split(*alertTo, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			b.to = append(b.to, name)
+		}
+	}
+	return b
+}
+
+func (*alertBot) Name() string { return "alertbot" }
+
+func (b *alertBot) Handle(m message, reply Replier) {
+	if m.Type != "chat" {
+		return
+	}
+	text := strings.ToLower(m.Text)
+	for _, w := range b.words {
+		if strings.Contains(text, w) {
+			for _, to := range b.to {
+				if to != m.From {
+					reply.Tell(to, fmt.Sprintf("%s 在 %s 提到了 %q: %s", m.From, m.Room, w, m.Text))
+				}
+			}
+			return
+		}
+	}
+}
@@ -0,0 +1,585 @@
+package main
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// --- 服务器互联 ---
+// 几台聊天服务器可以用服务器之间的 TCP 连接（链路）连成一张网，共享同一批房间:
+//
+//	chat -name bj -link-listen localhost:7000 -link-secret s3cr3t
+//	chat -name sh -addr localhost:8001 -links localhost:7000 -link-secret s3cr3t
+//
+// 链路上每行一个 JSON 格式的 linkFrame。连上之后双方先互发 hello（带上 -link-secret），
+// 对方能冒充任何人说话，所以没有配 -link-secret 时拒绝启动链路。
+// 之后房间发言、进出房间、改名、跨服务器私信都会变成 frame 发给所有链路。
+// 收到的 frame 再转发给除来路以外的其他链路，所以链路可以串成一条线或者一棵树。
+// 每个 frame 由 (origin, boot, id) 唯一标识，见过的直接丢掉，所以就算链路连成了环也不会无限转圈；
+// 不过有环时成员名单可能不准，最好还是连成树。
+//
+// 别的服务器上的人在这里显示成 "昵称@服务器名"，私信也可以这样写: /msg bob@sh 你好。
+// 本地昵称因此不能包含 @。
+//
+// 链路断开（netsplit）时，从这条链路过来的服务器上的人都会在各个房间里“走了”，
+// 并且用 split 告诉更远的服务器。重新连上后双方交换成员名单（sync/state），人又会“加入”回来。
+// 断开期间的发言不会补发。主动连接的一方按指数退避自动重连；同一对服务器只保留一条链路，
+// 所以 -links 只需要在一边配置。链路走明文 TCP，只应该在内网或者隧道里用。
+
+var (
+	serverName = flag.String("name", defaultServerName(), "this server's name on server-to-server links (must be unique)")
+	linkListen = flag.String("link-listen", "", "accept server-to-server links here (empty disables)")
+	linksFlag  = flag.String("links", "", "comma-separated addresses of servers to link to")
+	linkSecret = flag.String("link-secret", "", "shared secret both ends of a link must present (required with -link-listen and -links)")
+)
+
+const (
+	linkQueue     = 4096             // 每条链路的发送队列，满了说明对方太慢，直接断开
+	linkPing      = 30 * time.Second // 链路空闲时隔多久发一次 ping
+	maxLinkBuffer = 4 << 20          // 一行 frame 最长多少字节（state 里有整个服务器的成员名单）
+	seenSize      = 100000           // 记住最近多少个 frame 用来去重
+)
+
+// bootTime 区分同一台服务器的不同次启动：重启后消息号从头开始，不能被当成重复的
+var bootTime = time.Now().UnixNano()
+
+func defaultServerName() string {
+	name, err := os.Hostname()
+	if err != nil {
+		return "chat"
+	}
+	name, _, _ = strings.Cut(name, ".")
+	return name
+}
+
+// linkFrame 是链路上的一行
+//
+//	hello    连上后的第一行，origin 是自己的名字，secret 是 -link-secret
+//	ping     保活，不转发
+//	chat     origin 上的 from 在 room 里说了 text
+//	join     from 加入了 room；leave 是离开（quit 表示下线）
+//	nick     from 改名为 to
+//	private  私信，to 是 "昵称@服务器名"
+//	sync     请所有服务器重新发一次 state
+//	state    origin 上所有房间的成员名单
+//	split    origin 和 lost 里的这些服务器断开了
+type linkFrame struct {
+	Type   string              `json:"type"`
+	Origin string              `json:"origin"`
+	Boot   int64               `json:"boot,omitempty"`
+	ID     int64               `json:"id,omitempty"`
+	Time   time.Time           `json:"time,omitzero"`
+	Room   string              `json:"room,omitempty"`
+	From   string              `json:"from,omitempty"`
+	To     string              `json:"to,omitempty"`
+	Text   string              `json:"text,omitempty"`
+	Quit   bool                `json:"quit,omitempty"`
+	Rooms  map[string][]string `json:"rooms,omitempty"`
+	Lost   []string            `json:"lost,omitempty"`
+	Secret string              `json:"secret,omitempty"`
+}
+
+func (f linkFrame) key() string {
+	return fmt.Sprintf("%s/%d/%d", f.Origin, f.Boot, f.ID)
+}
+
+// link 是到另一台服务器的一条链路
+type link struct {
+	peer string // 对方的服务器名
+	conn net.Conn
+	out  chan linkFrame // 发送队列，由 broadcaster 写入和关闭
+	full bool           // 队列满了、已经断开，只由 broadcaster 读写
+}
+
+// linkUp 是“这条链路握手完成了”的请求，broadcaster 同意（nil）才开始收发
+type linkUp struct {
+	l      *link
+	result chan<- error
+}
+
+// linkEvent 是从链路收到的一个 frame
+type linkEvent struct {
+	l *link
+	f linkFrame
+}
+
+var (
+	linkUps    = make(chan linkUp)
+	linkDowns  = make(chan *link)
+	linkFrames = make(chan linkEvent)
+)
+
+// federation 是 broadcaster 私有的互联状态
+type federation struct {
+	links  map[string]*link                      // 对方服务器名 -> 直接相连的链路
+	route  map[string]*link                      // 服务器名 -> 它的消息是从哪条链路来的
+	remote map[string]map[string]map[string]bool // 服务器名 -> 房间名 -> 那台服务器上的成员昵称
+	seen   map[string]bool                       // 最近见过的 frame
+	order  []string                              // seen 的先后顺序，用来淘汰最旧的
+}
+
+func newFederation() *federation {
+	return &federation{
+		links:  make(map[string]*link),
+		route:  make(map[string]*link),
+		remote: make(map[string]map[string]map[string]bool),
+		seen:   make(map[string]bool),
+	}
+}
+
+// startFederation 按 -link-listen 和 -links 开始接受和发起链路
+func startFederation() {
+	if *linkListen == "" && *linksFlag == "" {
+		return
+	}
+	if *serverName == "" || strings.ContainsAny(*serverName, "@ \t") {
+		log.Fatal("-name 不能为空，也不能包含 @ 和空白")
+	}
+	if *linkSecret == "" {
+		// 否则谁连上链路端口，谁就能以任何服务器、任何人的名义发消息
+		log.Fatal("-link-listen 和 -links 必须配上 -link-secret")
+	}
+	if *linkListen != "" {
+		listener, err := net.Listen("tcp", *linkListen)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("服务器 %s 接受链路: %s", *serverName, *linkListen)
+		go func() {
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					log.Print(err)
+					continue
+				}
+				go runLink(conn)
+			}
+		}()
+	}
+	for _, addr := range strings.Split(*linksFlag, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			go dialLink(addr)
+		}
+	}
+}
+
+// dialLink 一直保持到 addr 的链路，断了就按指数退避重连
+func dialLink(addr string) {
+	backoff := time.Second
+	for {
+		conn, err := net.DialTimeout("tcp", addr, 10*time.Second)
+		if err != nil {
+			log.Printf("连接服务器 %s 失败: %v，%s 后重试", addr, err, backoff)
+		} else {
+			start := time.Now()
+			runLink(conn)
+			if time.Since(start) > time.Minute {
+				backoff = time.Second // 链路用了一阵子才断，说明对方是好的，从最短间隔开始重连
+			}
+			log.Printf("到 %s 的链路断开，%s 后重连", addr, backoff)
+		}
+		time.Sleep(backoff)
+		backoff = min(backoff*2, 30*time.Second)
+	}
+}
+
+// runLink 握手、登记链路，然后把收到的 frame 交给 broadcaster，直到链路断开
+func runLink(conn net.Conn) {
+	defer conn.Close()
+	input := bufio.NewScanner(conn)
+	input.Buffer(make([]byte, 64*1024), maxLinkBuffer)
+
+	// 1. 互发 hello
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	hello, _ := json.Marshal(linkFrame{Type: "hello", Origin: *serverName, Secret: *linkSecret})
+	if _, err := conn.Write(append(hello, '\n')); err != nil {
+		log.Printf("链路 %s 握手失败: %v", conn.RemoteAddr(), err)
+		return
+	}
+	peer, err := readHello(input)
+	if err != nil {
+		log.Printf("链路 %s 握手失败: %v", conn.RemoteAddr(), err)
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	// 2. 向 broadcaster 登记，同一台服务器已经连着的话就不要这一条了
+	l := &link{peer: peer, conn: conn, out: make(chan linkFrame, linkQueue)}
+	result := make(chan error)
+	linkUps <- linkUp{l, result}
+	if err := <-result; err != nil {
+		log.Printf("链路 %s: %v", conn.RemoteAddr(), err)
+		return
+	}
+	go l.writer()
+
+	// 3. 收 frame；对方至少每 linkPing 发一行，三个周期都没动静就认为链路断了
+	for {
+		conn.SetReadDeadline(time.Now().Add(3 * linkPing))
+		if !input.Scan() {
+			break
+		}
+		var f linkFrame
+		if err := json.Unmarshal(input.Bytes(), &f); err != nil {
+			log.Printf("来自 %s 的 frame 无法解析: %v", peer, err)
+			continue
+		}
+		if f.Type != "ping" {
+			linkFrames <- linkEvent{l, f}
+		}
+	}
+	if err := input.Err(); err != nil && !errors.Is(err, net.ErrClosed) {
+		log.Printf("链路 %s: %v", peer, err)
+	}
+	linkDowns <- l // broadcaster 会关闭 l.out，writer 随之退出
+}
+
+// readHello 读对方的 hello 并检查，返回对方的服务器名
+func readHello(input *bufio.Scanner) (string, error) {
+	if !input.Scan() {
+		if input.Err() != nil {
+			return "", input.Err()
+		}
+		return "", errors.New("对方关闭了连接")
+	}
+	var f linkFrame
+	if err := json.Unmarshal(input.Bytes(), &f); err != nil || f.Type != "hello" {
+		return "", errors.New("对方不是聊天服务器")
+	}
+	if subtle.ConstantTimeCompare([]byte(f.Secret), []byte(*linkSecret)) != 1 {
+		return "", errors.New("-link-secret 不对")
+	}
+	if f.Origin == "" || strings.ContainsAny(f.Origin, "@ \t") {
+		return "", fmt.Errorf("无效的服务器名 %q", f.Origin)
+	}
+	if f.Origin == *serverName {
+		return "", errors.New("连到了自己（或者两台服务器用了同一个 -name）")
+	}
+	return f.Origin, nil
+}
+
+// writer 把发送队列里的 frame 写到链路上，空闲时发 ping
+func (l *link) writer() {
+	defer l.conn.Close()
+	w := bufio.NewWriter(l.conn)
+	ping := time.NewTicker(linkPing)
+	defer ping.Stop()
+	for {
+		var f linkFrame
+		select {
+		case next, ok := <-l.out:
+			if !ok {
+				return
+			}
+			f = next
+		case <-ping.C:
+			f = linkFrame{Type: "ping", Origin: *serverName}
+		}
+		b, _ := json.Marshal(f)
+		l.conn.SetWriteDeadline(time.Now().Add(*writeTimeout))
+		w.Write(b)
+		w.WriteByte('\n')
+		if len(l.out) > 0 {
+			continue
+		}
+		if err := w.Flush(); err != nil {
+			l.conn.Close() // runLink 的读循环会因此结束
+			break
+		}
+	}
+	for range l.out {
+		// 链路已经坏了，丢掉剩下的 frame
+	}
+}
+
+// send 非阻塞地把 frame 放进链路的发送队列，队列满了就断开这条链路，只能由 broadcaster 调用
+func (l *link) send(f linkFrame) {
+	if l.full {
+		return
+	}
+	select {
+	case l.out <- f:
+	default:
+		l.full = true
+		log.Printf("到 %s 的链路太慢，断开", l.peer)
+		l.conn.Close()
+	}
+}
+
+// --- 以下都只能由 broadcaster 调用 ---
+
+// remember 记下一个 frame，已经见过的返回 false
+func (fed *federation) remember(f linkFrame) bool {
+	k := f.key()
+	if fed.seen[k] {
+		return false
+	}
+	fed.seen[k] = true
+	fed.order = append(fed.order, k)
+	if len(fed.order) > seenSize {
+		delete(fed.seen, fed.order[0])
+		fed.order = fed.order[1:]
+	}
+	return true
+}
+
+// federate 把本服务器上发生的事发给所有链路
+func (h *hub) federate(f linkFrame) {
+	if len(h.fed.links) == 0 {
+		return
+	}
+	f.Origin, f.Boot, f.ID = *serverName, bootTime, lastID.Add(1)
+	if f.Time.IsZero() {
+		f.Time = time.Now().UTC()
+	}
+	h.fed.remember(f)
+	for _, l := range h.fed.links {
+		l.send(f)
+	}
+}
+
+// linkUp 登记一条新链路，然后请全网重新交换成员名单
+func (h *hub) linkUp(l *link) error {
+	if _, ok := h.fed.links[l.peer]; ok {
+		return fmt.Errorf("已经有一条到 %s 的链路了", l.peer)
+	}
+	h.fed.links[l.peer] = l
+	log.Printf("和服务器 %s 连上了", l.peer)
+	h.federate(linkFrame{Type: "sync"})
+	h.federate(h.stateFrame())
+	return nil
+}
+
+// linkDown 处理链路断开（netsplit）：从这条链路过来的服务器上的人都算下线
+func (h *hub) linkDown(l *link) {
+	if h.fed.links[l.peer] == l {
+		delete(h.fed.links, l.peer)
+		log.Printf("和服务器 %s 断开了", l.peer)
+	}
+	close(l.out)
+
+	var lost []string
+	for origin, r := range h.fed.route {
+		if r == l {
+			lost = append(lost, origin)
+		}
+	}
+	sort.Strings(lost)
+	for _, origin := range lost {
+		h.dropOrigin(origin, "netsplit "+*serverName+" "+l.peer)
+	}
+	if len(lost) > 0 {
+		h.federate(linkFrame{Type: "split", Lost: lost})
+	}
+}
+
+// relay 处理从链路 l 收到的 frame：去重、转发给其他链路，再在本地生效
+func (h *hub) relay(l *link, f linkFrame) {
+	if err := f.check(); err != nil {
+		log.Printf("丢掉来自 %s 的 frame: %v", l.peer, err)
+		return
+	}
+	if f.Origin == *serverName || !h.fed.remember(f) {
+		return // 自己发出去又绕回来的，或者已经从别的路收到过
+	}
+	h.fed.route[f.Origin] = l
+	for _, other := range h.fed.links {
+		if other != l {
+			other.send(f)
+		}
+	}
+
+	who := f.From + "@" + f.Origin
+	switch f.Type {
+	case "chat":
+		m := chat(f.Room, who, f.Text)
+		m.Time = f.Time
+		h.post(m)
+
+	case "join":
+		h.remoteJoin(f.Origin, f.Room, f.From)
+
+	case "leave":
+		text := who + " 离开了"
+		if f.Quit {
+			text = who + " 走了"
+		}
+		h.remoteLeave(f.Origin, f.Room, f.From, text, f.Quit)
+
+	case "nick":
+		h.remoteNick(f.Origin, f.From, f.To)
+
+	case "private":
+		name, server, _ := strings.Cut(f.To, "@")
+		if to, ok := h.clients[name]; ok && server == *serverName {
+			to.deliver(private(who, name, f.Text, false))
+		}
+
+	case "sync":
+		h.federate(h.stateFrame())
+
+	case "state":
+		h.applyState(f.Origin, f.Rooms)
+
+	case "split":
+		// 只有本来就是经过 l 才能到的服务器才真的断开了，换了条路连上的不算
+		for _, origin := range f.Lost {
+			if h.fed.route[origin] == l {
+				h.dropOrigin(origin, "netsplit "+f.Origin)
+			}
+		}
+	}
+}
+
+// check 检查别的服务器转来的 frame：服务器名、昵称、房间名里不能有空白和控制字符，
+// 文字里的控制字符去掉（见 cleanText）。对方不一定和我们跑同一版代码，不能假设它洗过了
+func (f *linkFrame) check() error {
+	bad := func(s string) bool {
+		return strings.IndexFunc(s, unicode.IsSpace) >= 0 || strings.IndexFunc(s, unicode.IsControl) >= 0
+	}
+	names := append([]string{f.Origin, f.Room, f.From, f.To}, f.Lost...)
+	for room, members := range f.Rooms {
+		names = append(names, room)
+		names = append(names, members...)
+	}
+	for _, s := range names {
+		if bad(s) {
+			return fmt.Errorf("名字 %q 里有空白或控制字符", s)
+		}
+	}
+	f.Text = cleanText(f.Text)
+	return nil
+}
+
+// stateFrame 是本服务器所有房间的成员名单
+func (h *hub) stateFrame() linkFrame {
+	rooms := make(map[string][]string)
+	for room, members := range h.rooms {
+		rooms[room] = memberNames(members)
+	}
+	return linkFrame{Type: "state", Rooms: rooms}
+}
+
+// applyState 用 origin 发来的成员名单替换原来记下的，多出来的人加入、少了的人离开
+func (h *hub) applyState(origin string, rooms map[string][]string) {
+	old := h.fed.remote[origin]
+	for room, members := range old {
+		for name := range members {
+			if !slices.Contains(rooms[room], name) {
+				h.remoteLeave(origin, room, name, name+"@"+origin+" 离开了", false)
+			}
+		}
+	}
+	for room, names := range rooms {
+		for _, name := range names {
+			if !old[room][name] {
+				h.remoteJoin(origin, room, name)
+			}
+		}
+	}
+}
+
+// dropOrigin 让 origin 上的人都下线，链路断开时调用
+func (h *hub) dropOrigin(origin, why string) {
+	for _, room := range sortedKeys(h.fed.remote[origin]) {
+		for _, name := range sortedKeys(h.fed.remote[origin][room]) {
+			h.remoteLeave(origin, room, name, name+"@"+origin+" 走了（"+why+"）", true)
+		}
+	}
+	delete(h.fed.remote, origin)
+	delete(h.fed.route, origin)
+}
+
+// remoteJoin 记下 origin 上的 name 加入了 room，并通知本地房间里的人
+func (h *hub) remoteJoin(origin, room, name string) {
+	rooms := h.fed.remote[origin]
+	if rooms == nil {
+		rooms = make(map[string]map[string]bool)
+		h.fed.remote[origin] = rooms
+	}
+	if rooms[room] == nil {
+		rooms[room] = make(map[string]bool)
+	}
+	rooms[room][name] = true
+	who := name + "@" + origin
+	h.notice("join", room, who, who+" 加入了")
+}
+
+// remoteLeave 记下 origin 上的 name 离开了 room，并通知本地房间里的人
+func (h *hub) remoteLeave(origin, room, name, text string, quit bool) {
+	members := h.fed.remote[origin][room]
+	if !members[name] {
+		return
+	}
+	delete(members, name)
+	if len(members) == 0 {
+		delete(h.fed.remote[origin], room)
+	}
+	left := roomEvent("leave", room, name+"@"+origin, text)
+	left.Quit = quit
+	h.roomcast(room, left)
+	h.transcript.record(room, "* "+text)
+}
+
+// remoteNick 处理 origin 上的改名，通知和他同在一个房间的本地用户（每人一次）
+func (h *hub) remoteNick(origin, old, new string) {
+	msg := nickChange(old+"@"+origin, new+"@"+origin)
+	sent := make(map[*client]bool)
+	for room, members := range h.fed.remote[origin] {
+		if !members[old] {
+			continue
+		}
+		delete(members, old)
+		members[new] = true
+		h.transcript.record(room, "* "+msg.Text)
+		for cli := range h.rooms[room] {
+			if !sent[cli] {
+				sent[cli] = true
+				cli.deliver(msg)
+			}
+		}
+	}
+}
+
+// remoteNames 返回别的服务器上在 room 里的人（"昵称@服务器名"），room 为空时返回所有人
+func (h *hub) remoteNames(room string) []string {
+	var names []string
+	for origin, rooms := range h.fed.remote {
+		seen := make(map[string]bool)
+		for r, members := range rooms {
+			if room != "" && r != room {
+				continue
+			}
+			for name := range members {
+				if !seen[name] {
+					seen[name] = true
+					names = append(names, name+"@"+origin)
+				}
+			}
+		}
+	}
+	return names
+}
+
+// sendRemote 把私信发给别的服务器上的 to（"昵称@服务器名"）
+func (h *hub) sendRemote(from *client, to, text string) {
+	_, server, _ := strings.Cut(to, "@")
+	if _, ok := h.fed.route[server]; !ok {
+		from.tell("没有连上服务器 " + server)
+		return
+	}
+	h.federate(linkFrame{Type: "private", From: from.name, To: to, Text: text})
+	from.deliver(private(from.name, to, text, true))
+}
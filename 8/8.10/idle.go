@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// --- 空闲超时与心跳 ---
+// -idle：用户超过这么久没发言（命令也算发言）就断开，断开前 -idle-warn 先提醒一次。
+// -heartbeat：每隔这么久给客户端发一行 "PING <n>"，客户端应回 "PONG <n>"；
+// 超过两个周期收不到对方任何数据，就认为 TCP 对端已经死了，直接断开。
+// 心跳默认关闭，因为 nc 这类纯文本客户端不会自动回 PONG。
+// 不管因为什么断开，都是让读循环结束，照常走 leaving 流程通知房间里的人。
+
+var (
+	idleTimeout = flag.Duration("idle", 10*time.Minute, "disconnect users who send nothing for this long (0 disables)")
+	idleWarn    = flag.Duration("idle-warn", time.Minute, "warn users this long before the idle disconnect")
+	heartbeat   = flag.Duration("heartbeat", 0, "send PING at this interval and drop peers that stay silent for two intervals (0 disables)")
+)
+
+// lineReader 按行读取客户端输入，并记录最后一次收到数据和最后一次发言的时间
+// 心跳打开时，PONG 行在这里就被吃掉，不会当成聊天内容
+type lineReader struct {
+	input    *bufio.Scanner
+	lastSeen atomic.Int64 // 最后一次收到任何一行的时间 (UnixNano)
+	lastMsg  atomic.Int64 // 最后一次收到发言（不含 PONG）的时间 (UnixNano)
+}
+
+func newLineReader(input *bufio.Scanner) *lineReader {
+	r := &lineReader{input: input}
+	now := time.Now().UnixNano()
+	r.lastSeen.Store(now)
+	r.lastMsg.Store(now)
+	return r
+}
+
+// next 返回下一行发言，连接断开时返回 false
+func (r *lineReader) next() (string, bool) {
+	for r.input.Scan() {
+		now := time.Now().UnixNano()
+		r.lastSeen.Store(now)
+		line := r.input.Text()
+		if *heartbeat > 0 && (line == "PONG" || strings.HasPrefix(line, "PONG ")) {
+			continue
+		}
+		r.lastMsg.Store(now)
+		return line, true
+	}
+	return "", false
+}
+
+// watchdog 负责空闲提醒、空闲断开和心跳，每个连接一个
+// 它会往 cli.ch 里写消息，所以必须在 stop 关闭、done 返回之后，handleConn 才能去 leaving 注销
+func watchdog(cli *client, r *lineReader, stop <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+	if *idleTimeout <= 0 && *heartbeat <= 0 {
+		<-stop
+		return
+	}
+
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	warned := false
+	var pings int
+	nextPing := time.Now().Add(*heartbeat)
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-timer.C:
+		}
+		now := time.Now()
+		next := now.Add(time.Hour) // 下一次需要醒来检查的时间
+
+		if *idleTimeout > 0 {
+			lastMsg := time.Unix(0, r.lastMsg.Load())
+			idle := now.Sub(lastMsg)
+			warnAt := lastMsg.Add(*idleTimeout - *idleWarn)
+			switch {
+			case idle >= *idleTimeout:
+				cli.ch <- system(fmt.Sprintf("你已经 %s 没有发言，连接将被断开", idleTimeout.Round(time.Second)))
+				log.Printf("%s 空闲超时，断开连接", cli.conn.RemoteAddr())
+				// 只打断读循环，不直接关连接：让 clientWriter 把上面这句话发出去后再关
+				cli.conn.SetReadDeadline(now)
+				return
+			case *idleWarn > 0 && !warned && !now.Before(warnAt):
+				warned = true
+				left := lastMsg.Add(*idleTimeout).Sub(now).Round(time.Second)
+				cli.ch <- system(fmt.Sprintf("你已经 %s 没有发言，%s 后将被断开，发任意消息即可保持在线", idle.Round(time.Second), left))
+			case now.Before(warnAt):
+				warned = false // 提醒之后又说话了，下次还要提醒
+			}
+			if warned {
+				next = earliest(next, lastMsg.Add(*idleTimeout))
+			} else {
+				next = earliest(next, warnAt)
+			}
+		}
+
+		if *heartbeat > 0 {
+			lastSeen := time.Unix(0, r.lastSeen.Load())
+			deadline := lastSeen.Add(2 * *heartbeat)
+			if !now.Before(deadline) {
+				log.Printf("%s 心跳超时，断开连接", cli.conn.RemoteAddr())
+				cli.conn.Close()
+				return
+			}
+			if !now.Before(nextPing) {
+				pings++
+				cli.ch <- newMessage("ping", fmt.Sprintf("PING %d", pings))
+				nextPing = now.Add(*heartbeat)
+			}
+			next = earliest(next, nextPing, deadline)
+		}
+
+		timer.Reset(next.Sub(now))
+	}
+}
+
+func earliest(t time.Time, ts ...time.Time) time.Time {
+	for _, u := range ts {
+		if u.Before(t) {
+			t = u
+		}
+	}
+	return t
+}
@@ -0,0 +1,413 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"time"
+)
+
+// --- IRC 兼容 ---
+// 另开一个端口（-irc），让普通的 IRC 客户端（irssi、WeeChat、HexChat……）也能连进来。
+// 支持的命令只是够用的那一小部分:
+//
+//	NICK / USER / PASS    登记；注册过的昵称要在 NICK 之前用 PASS 给出密码
+//	JOIN / PART           加入、离开房间（房间就是 IRC 的频道，都以 # 开头）
+//	PRIVMSG               发到 #房间 是发言，发给昵称是私信
+//	NAMES / LIST / KICK   对应 /who #房间、/rooms、/kick
+//	PING / PONG / QUIT
+//	TOPIC / MODE / WHO    只回一个空的结果，免得客户端一直等
+//
+// IRC 连接和 TCP、WebSocket 连接一样交给 broadcaster，只是收发的格式不同:
+// 读进来的命令在 handleIRC 里翻译成 broadcaster 的请求，
+// 发出去的 message 由 ircSession.encode 翻译成 IRC 的行（CRLF 结尾）。
+// 服务器的提示（system 消息）统一用 NOTICE 发出。
+
+var ircAddr = flag.String("irc", "localhost:6667", "accept IRC clients here (empty disables)")
+
+// ircServer 是 IRC 消息里服务器自己的名字，也用作所有用户的主机名
+const ircServer = "chat"
+
+// serveIRC 在 addr 上接受 IRC 客户端
+func serveIRC(addr string) {
+	listener, err := listen(addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("IRC 端口: %s", addr)
+	serve(listener, handleIRC, "ERROR :Your address is banned")
+}
+
+// ircSession 是一个 IRC 连接的编码状态，只由 clientWriter 使用
+// IRC 的每一行都要带上自己的昵称，所以它跟着 welcome 和 nick 消息记下当前昵称
+type ircSession struct {
+	nick string // 还没登记时是 "*"
+}
+
+// ircLine 是一行原样发给 IRC 客户端的消息，只会发给 IRC 连接
+func ircLine(line string) message {
+	return newMessage("irc", line)
+}
+
+// numeric 是一条 IRC 数字回复，text 是数字和昵称之后的部分，昵称在发出去时才填上
+func numeric(code, text string) message {
+	return newMessage("numeric", code+" "+text)
+}
+
+// ircUser 是 IRC 消息的发送者前缀 nick!user@host
+func ircUser(nick string) string {
+	return ":" + nick + "!" + nick + "@" + ircServer
+}
+
+// encode 把一条 message 翻译成 IRC 的行，没有对应说法的消息返回 nil
+// 文字在进来的时候已经洗过了（见 cleanText），这里再去掉一遍控制字符，保证一条消息不会变成好几行
+func (s *ircSession) encode(m message) []string {
+	lines := s.lines(m)
+	for i, line := range lines {
+		lines[i] = cleanText(line)
+	}
+	return lines
+}
+
+func (s *ircSession) lines(m message) []string {
+	me := s.nick
+	server := ":" + ircServer + " "
+	reply := func(code, text string) string {
+		return server + code + " " + s.nick + " " + text
+	}
+
+	switch m.Type {
+	case "welcome":
+		s.nick = m.To
+		return []string{
+			reply("001", ":Welcome to the chat server, "+s.nick),
+			reply("002", ":Your host is "+ircServer),
+			reply("003", ":This server speaks a small subset of IRC"),
+			reply("004", ircServer+" chat o o"),
+			reply("422", ":MOTD File is missing"),
+		}
+
+	case "chat":
+		if m.From == me && !m.History {
+			return nil // IRC 客户端自己会显示自己说的话
+		}
+		text := m.Text
+		if m.History {
+			text = "[" + m.Time.Local().Format("01-02 15:04") + "] " + text
+		}
+		return []string{ircUser(m.From) + " PRIVMSG " + m.Room + " :" + text}
+
+	case "join":
+		lines := []string{ircUser(m.From) + " JOIN " + m.Room}
+		if m.From == me {
+			lines = append(lines, reply("331", m.Room+" :No topic is set"))
+			lines = append(lines, s.names(m.Room, m.Names)...)
+		}
+		return lines
+
+	case "leave":
+		switch {
+		case m.Quit:
+			return []string{ircUser(m.From) + " QUIT :" + m.Text}
+		case m.From == me:
+			return []string{ircUser(m.From) + " PART " + m.Room}
+		default:
+			return []string{ircUser(m.From) + " PART " + m.Room + " :" + m.Text}
+		}
+
+	case "nick":
+		if m.From == me {
+			s.nick = m.To
+		}
+		return []string{ircUser(m.From) + " NICK :" + m.To}
+
+	case "private":
+		if m.From == me && m.To != me {
+			return nil // 发信人自己的回执
+		}
+		return []string{ircUser(m.From) + " PRIVMSG " + me + " :" + m.Text}
+
+	case "system":
+		if m.Names != nil {
+			room := m.Room
+			if room == "" {
+				room = "*"
+			}
+			return s.names(room, m.Names)
+		}
+		return []string{server + "NOTICE " + me + " :" + m.Text}
+
+	case "ping":
+		return []string{"PING :" + strings.TrimPrefix(m.Text, "PING ")}
+
+	case "numeric":
+		code, text, _ := strings.Cut(m.Text, " ")
+		return []string{reply(code, text)}
+
+	case "irc":
+		return []string{m.Text}
+	}
+	return nil // ack 等
+}
+
+// names 是 NAMES 的回复（353 和 366）
+func (s *ircSession) names(room string, names []string) []string {
+	server := ":" + ircServer + " "
+	return []string{
+		server + "353 " + s.nick + " = " + room + " :" + strings.Join(names, " "),
+		server + "366 " + s.nick + " " + room + " :End of /NAMES list",
+	}
+}
+
+// parseIRC 把一行 IRC 消息拆成命令和参数；以 : 开头的参数一直到行尾
+func parseIRC(line string) (cmd string, params []string) {
+	line = strings.TrimSpace(line)
+	if strings.HasPrefix(line, ":") {
+		// 客户端发来的前缀没有意义，丢掉
+		_, line, _ = strings.Cut(line, " ")
+	}
+	for line != "" {
+		if strings.HasPrefix(line, ":") && cmd != "" {
+			params = append(params, line[1:])
+			break
+		}
+		var field string
+		field, line, _ = strings.Cut(line, " ")
+		line = strings.TrimLeft(line, " ")
+		if cmd == "" {
+			cmd = strings.ToUpper(field)
+		} else {
+			params = append(params, field)
+		}
+	}
+	return cmd, params
+}
+
+// handleIRC 处理一个 IRC 客户端的生命周期，和 handleConn 一样由 clientWriter 最后关闭连接
+func handleIRC(conn net.Conn) {
+	ch := make(chan message, *queueSize)
+	cli := &client{ch: ch, conn: conn, irc: &ircSession{nick: "*"}}
+	go clientWriter(cli)
+
+	input := newLineReader(bufio.NewScanner(conn))
+	stop, done := make(chan struct{}), make(chan struct{})
+	go watchdog(cli, input, stop, done)
+	stopWatchdog := func() {
+		close(stop)
+		<-done
+	}
+
+	// 1. 登记：NICK 和 USER 都收到了才算
+	if !ircRegister(cli, input) {
+		stopWatchdog()
+		close(ch)
+		return
+	}
+
+	// 2. 之后的每一行都翻译成 broadcaster 的请求，和 handleConn 一样限流
+	limiter := newTokenBucket(*msgRate, *msgBurst)
+	for {
+		line, ok := input.next()
+		if !ok {
+			break
+		}
+		cmd, params := parseIRC(cleanText(line))
+		if cmd == "" {
+			continue
+		}
+		if !limiter.allow(time.Now()) {
+			ch <- system("发得太快了，这一行没有发出去")
+			continue
+		}
+		if cmd == "QUIT" {
+			ch <- ircLine("ERROR :Closing link")
+			break
+		}
+		ircCommand(cli, cmd, params)
+	}
+
+	stopWatchdog()
+	leaving <- cli
+}
+
+// ircRegister 处理登记阶段的命令，直到登记成功或连接断开
+func ircRegister(cli *client, input *lineReader) bool {
+	var nick, pass string
+	user := false
+	for {
+		line, ok := input.next()
+		if !ok {
+			return false
+		}
+		cmd, params := parseIRC(cleanText(line))
+		switch cmd {
+		case "":
+			continue
+		case "CAP":
+			if len(params) > 0 && strings.ToUpper(params[0]) == "LS" {
+				cli.ch <- ircLine(":" + ircServer + " CAP * LS :")
+			}
+			continue
+		case "PASS":
+			if len(params) > 0 {
+				pass = params[0]
+			}
+			continue
+		case "NICK":
+			if len(params) == 0 {
+				cli.ch <- numeric("431", ":No nickname given")
+				continue
+			}
+			if err := validNick(params[0]); err != nil {
+				cli.ch <- numeric("432", params[0]+" :"+err.Error())
+				continue
+			}
+			nick = params[0]
+		case "USER":
+			if len(params) < 4 {
+				cli.ch <- numeric("461", "USER :Not enough parameters")
+				continue
+			}
+			user = true
+		case "PING":
+			cli.ch <- ircLine(":" + ircServer + " PONG " + ircServer + " :" + strings.Join(params, " "))
+			continue
+		case "QUIT":
+			cli.ch <- ircLine("ERROR :Closing link")
+			return false
+		default:
+			cli.ch <- numeric("451", ":You have not registered")
+			continue
+		}
+		if nick == "" || !user {
+			continue
+		}
+
+		if users.registered(nick) {
+			// 注册过的昵称要先验证密码，用 PASS 给出
+			if err := users.login(remoteIP(cli.conn), nick, pass); err != nil {
+				cli.ch <- numeric("464", ":Password incorrect")
+				cli.ch <- system("昵称 " + nick + " 已注册: " + err.Error())
+				nick = ""
+				continue
+			}
+		}
+		result := make(chan error)
+		entering <- nickRequest{cli, nick, result}
+		if err := <-result; err != nil {
+			cli.ch <- numeric("433", nick+" :Nickname is already in use")
+			nick = ""
+			continue
+		}
+		return true
+	}
+}
+
+// ircCommand 处理登记之后的一条 IRC 命令
+func ircCommand(cli *client, cmd string, params []string) {
+	arg := func(i int) string {
+		if i < len(params) {
+			return params[i]
+		}
+		return ""
+	}
+
+	switch cmd {
+	case "PING":
+		cli.ch <- ircLine(":" + ircServer + " PONG " + ircServer + " :" + strings.Join(params, " "))
+
+	case "PONG", "NOTICE":
+		// 心跳关闭时 PONG 会走到这里；NOTICE 按规矩不回复
+
+	case "NICK":
+		name := arg(0)
+		if err := validNick(name); err != nil {
+			cli.ch <- numeric("432", name+" :"+err.Error())
+			return
+		}
+		if users.registered(name) {
+			cli.ch <- numeric("433", name+" :Nickname is registered, reconnect with PASS to use it")
+			return
+		}
+		result := make(chan error)
+		renames <- nickRequest{cli, name, result}
+		if err := <-result; err != nil {
+			cli.ch <- numeric("433", name+" :Nickname is already in use")
+		}
+
+	case "JOIN":
+		for _, room := range strings.Split(arg(0), ",") {
+			if err := validRoom(room); err != nil {
+				cli.ch <- numeric("403", room+" :"+err.Error())
+				continue
+			}
+			joins <- roomRequest{cli, room}
+		}
+
+	case "PART":
+		for _, room := range strings.Split(arg(0), ",") {
+			if err := validRoom(room); err != nil {
+				cli.ch <- numeric("403", room+" :"+err.Error())
+				continue
+			}
+			parts <- roomRequest{cli, room}
+		}
+
+	case "PRIVMSG":
+		switch {
+		case arg(0) == "":
+			cli.ch <- numeric("411", ":No recipient given (PRIVMSG)")
+		case arg(1) == "":
+			cli.ch <- numeric("412", ":No text to send")
+		case strings.HasPrefix(arg(0), "#"):
+			messages <- chatMsg{cli, arg(1), "", arg(0)}
+		default:
+			privates <- privateMsg{cli, arg(0), arg(1)}
+		}
+
+	case "NAMES":
+		if arg(0) == "" {
+			whos <- roomRequest{cli, ""}
+			return
+		}
+		for _, room := range strings.Split(arg(0), ",") {
+			whos <- roomRequest{cli, room}
+		}
+
+	case "LIST":
+		roomList <- cli
+
+	case "KICK":
+		// KICK #房间 昵称 [原因]；我们的踢人是踢出整个聊天室
+		if arg(1) == "" {
+			cli.ch <- numeric("461", "KICK :Not enough parameters")
+			return
+		}
+		mods <- modRequest{cli, "kick", strings.TrimSpace(arg(1) + " " + arg(2))}
+
+	case "TOPIC":
+		cli.ch <- numeric("331", arg(0)+" :No topic is set")
+
+	case "MODE":
+		switch {
+		case !strings.HasPrefix(arg(0), "#"):
+			cli.ch <- numeric("221", "+")
+		case arg(1) == "":
+			cli.ch <- numeric("324", arg(0)+" +")
+		case strings.Contains(arg(1), "b"):
+			cli.ch <- numeric("368", arg(0)+" :End of channel ban list")
+		}
+
+	case "WHO":
+		cli.ch <- numeric("315", arg(0)+" :End of WHO list")
+
+	case "USER", "PASS":
+		cli.ch <- numeric("462", ":You may not reregister")
+
+	default:
+		cli.ch <- numeric("421", fmt.Sprintf("%s :Unknown command", cmd))
+	}
+}
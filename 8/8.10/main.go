@@ -2,97 +2,605 @@ package main
 
 import (
 	"bufio"
+	"crypto/tls"
+	"flag"
 	"fmt"
 	"log"
 	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+	"unicode"
+	"unicode/utf8"
 )
 
-// client 类型定义为一个只写的字符串通道
-// 这一头是往里写数据的，另一头（clientWriter）是读数据的
-type client chan<- string
+var listenAddr = flag.String("addr", "localhost:8000", "listen for chat clients (nc, telnet, chat-demo) here")
+
+// client 代表一个在线用户
+// 除了 ch、conn、json 和 irc 以外的字段都只由 broadcaster 读写，其他 Goroutine 不要碰它们
+type client struct {
+	name    string          // 昵称
+	ch      chan message    // 有界的消息队列，另一头（clientWriter）负责读出来发给用户
+	conn    net.Conn        // 网络连接，慢客户端被踢时用来断开它
+	json    atomic.Bool     // 用 JSON Lines 还是纯文本收发（见 protocol.go）
+	irc     *ircSession     // 不为空表示这是 IRC 连接（见 irc.go）
+	rooms   map[string]bool // 加入的房间
+	current string          // 当前房间，普通发言发到这里；为空表示不在任何房间
+	dropped int             // 因为队列满而丢弃的消息数（见 slow.go）
+	kicked  bool            // 已经因为太慢被断开，不再投递
+}
+
+// nickRequest 是“我要用这个昵称”的请求，登记和改名都用它
+// broadcaster 处理完后把结果（nil 表示成功）写回 result
+type nickRequest struct {
+	cli    *client
+	name   string
+	result chan<- error
+}
+
+// chatMsg 是一条普通聊天消息，由 broadcaster 加上发送者的昵称后发到 room（为空时是他的当前房间）
+// ref 不为空时，广播完再给发送者回一个 ack
+type chatMsg struct {
+	from *client
+	text string
+	ref  string
+	room string
+}
+
+// privateMsg 是一条私信，只发给昵称为 to 的用户
+type privateMsg struct {
+	from *client
+	to   string
+	text string
+}
+
+// roomRequest 是 /join、/part、/who #room 的请求
+type roomRequest struct {
+	cli  *client
+	room string
+}
+
+// query 向 broadcaster 询问 cli 的某个字段（当前房间、昵称），答案写回 reply
+type query struct {
+	cli   *client
+	reply chan<- string
+}
 
 var (
-	// 三个全局核心通道
-	entering = make(chan client) // 新用户注册通道
-	leaving  = make(chan client) // 用户离开注销通道
-	messages = make(chan string) // 全局广播消息通道
+	// 广播中心的输入通道
+	entering = make(chan nickRequest) // 新用户带着昵称来登记
+	leaving  = make(chan *client)     // 用户离开注销通道
+	messages = make(chan chatMsg)     // 聊天消息通道，按发送者的当前房间广播
+	renames  = make(chan nickRequest) // /nick 改名
+	privates = make(chan privateMsg)  // /msg 私信
+	whos     = make(chan roomRequest) // /who 查询在线名单，结果直接发回给这个用户
+	joins    = make(chan roomRequest) // /join 加入（或切换到）房间
+	parts    = make(chan roomRequest) // /part 离开房间
+	roomList = make(chan *client)     // /rooms 列出所有房间
+	currents = make(chan query)       // 查询用户的当前房间（/history 用）
+	names    = make(chan query)       // 查询用户的昵称（/register 用）
 )
 
 func main() {
-	// 1. 启动监听，端口 8000
-	listener, err := net.Listen("tcp", "localhost:8000")
+	flag.Parse()
+	if *queueSize < 1 || (*slowPolicy != "drop" && *slowPolicy != "kick") {
+		log.Fatal("-queue 必须大于 0，-slow 只能是 drop 或 kick")
+	}
+	if *idleTimeout > 0 && *idleWarn >= *idleTimeout {
+		log.Fatal("-idle-warn 必须小于 -idle")
+	}
+
+	if (*tlsCert == "") != (*tlsKey == "") {
+		log.Fatal("-tls-cert 和 -tls-key 必须同时给出")
+	}
+
+	// 1. 启动监听，默认端口 8000；配了证书就走 TLS
+	listener, err := listen(*listenAddr)
 	if err != nil {
 		log.Fatal(err)
 	}
-	log.Println("聊天服务器启动，监听 localhost:8000 ...")
+	log.Printf("聊天服务器启动，监听 %s ...", *listenAddr)
 
-	// 2. 启动广播中心（后台管理 Goroutine）
-	go broadcaster()
+	if *usersPath != "" {
+		users, err = loadAccounts(*usersPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	parseOps(*opsFlag)
+	bans, err = loadBans(*bansPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// 2. 打开聊天记录文件，启动广播中心（后台管理 Goroutine）
+	var tr *transcript
+	if *transcriptPath != "" {
+		tr, err = openTranscript(*transcriptPath, *transcriptMax, *transcriptKeep)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	go broadcaster(tr, newBots(*botsFlag))
+	startFederation() // 和其他服务器互联（见 federation.go）
+	if *httpAddr != "" {
+		go serveHTTP(*httpAddr) // 浏览器走 WebSocket 网关（见 websocket.go）
+	}
+	if *ircAddr != "" {
+		go serveIRC(*ircAddr) // IRC 客户端走单独的端口（见 irc.go）
+	}
 
 	// 3. 循环等待用户连接
+	serve(listener, handleConn, "你的地址已被封禁")
+}
+
+// listen 在 addr 上监听，配了 -tls-cert/-tls-key 就走 TLS
+func listen(addr string) (net.Listener, error) {
+	if *tlsCert == "" {
+		return net.Listen("tcp", addr)
+	}
+	cert, err := tls.LoadX509KeyPair(*tlsCert, *tlsKey)
+	if err != nil {
+		return nil, err
+	}
+	return tls.Listen("tcp", addr, &tls.Config{Certificates: []tls.Certificate{cert}})
+}
+
+// serve 循环接受连接，为每个连接启动一个 handle Goroutine
+// 被封禁的地址只收到 banned 这一行就被断开
+func serve(listener net.Listener, handle func(net.Conn), banned string) {
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
 			log.Print(err)
 			continue
 		}
+		if bans.banned(conn) {
+			// 被封禁的地址：说一声就断开，不占用任何资源
+			conn.SetWriteDeadline(time.Now().Add(time.Second))
+			fmt.Fprintln(conn, banned)
+			conn.Close()
+			continue
+		}
 		// 4. 为每一个连接进来的用户启动一个专属的处理 Goroutine
-		go handleConn(conn)
+		go handle(conn)
 	}
 }
 
-// broadcaster 是广播中心，它维护所有在线用户的集合
-// 它是唯一能访问 clients map 的 Goroutine，所以不需要锁
-func broadcaster() {
-	clients := make(map[client]bool) // 记录当前所有在线的客户端通道
+// broadcaster 是广播中心，它维护所有在线用户和房间
+// 它是唯一能访问 hub 和 client 内部字段的 Goroutine，所以不需要锁
+func broadcaster(tr *transcript, bots map[string]*botRunner) {
+	h := newHub(tr, bots)
 
 	for {
-		// select 多路复用，监听三个通道的动静
+		// select 多路复用，监听所有输入通道的动静
 		select {
 		case msg := <-messages:
-			// 情况A: 全局消息通道有新消息 -> 广播给所有人
-			for cli := range clients {
-				cli <- msg // 把消息塞入每个用户的专属通道
+			// 情况A: 有人说话 -> 加上昵称广播给他当前房间里的所有人
+			cli := msg.from
+			if h.muted(cli) {
+				if msg.ref != "" {
+					cli.deliver(ack(msg.ref))
+				}
+				continue
+			}
+			room := msg.room
+			if room == "" {
+				room = cli.current
+			}
+			if !cli.rooms[room] {
+				if room == "" {
+					cli.tell("你不在任何房间，先用 /join #房间名 加入一个")
+				} else {
+					cli.tell("你不在房间 " + room + " 里")
+				}
+				if msg.ref != "" {
+					cli.deliver(ack(msg.ref))
+				}
+				continue
+			}
+			id := h.say(room, cli.name, msg.text)
+			if msg.ref != "" {
+				a := ack(msg.ref)
+				a.ID = id // 发言的确认带上这条发言的消息号
+				cli.deliver(a)
 			}
 
-		case cli := <-entering:
-			// 情况B: 有新用户进来 -> 在名册上登记
-			clients[cli] = true
+		case req := <-entering:
+			// 情况B: 有新用户进来 -> 昵称没被占用就在名册上登记，并放进默认房间
+			if h.nickTaken(req.name) {
+				req.result <- fmt.Errorf("昵称 %s 已被占用", req.name)
+				continue
+			}
+			req.cli.name = req.name
+			req.cli.rooms = make(map[string]bool)
+			h.clients[req.name] = req.cli
+			req.result <- nil
+			req.cli.deliver(welcome(req.name)) // 欢迎语（只发给自己）
+			h.join(req.cli, defaultRoom)
 
 		case cli := <-leaving:
-			// 情况C: 有用户离开 -> 删除名单，并关闭他的通道
-			delete(clients, cli)
-			close(cli)
+			// 情况C: 有用户离开 -> 退出所有房间（会通知房间里的人），删除名单，关闭他的通道
+			h.partAll(cli, cli.name+" 走了")
+			delete(h.clients, cli.name)
+			close(cli.ch)
+
+		case req := <-renames:
+			// 情况D: 改名 -> 新昵称没被占用才生效，通知他所在房间的人
+			old := req.cli.name
+			if h.muteLeft(old) > 0 {
+				req.result <- fmt.Errorf("禁言期间不能改名") // 禁言是按昵称记的
+				continue
+			}
+			if h.nickTaken(req.name) {
+				req.result <- fmt.Errorf("昵称 %s 已被占用", req.name)
+				continue
+			}
+			delete(h.clients, old)
+			req.cli.name = req.name
+			h.clients[req.name] = req.cli
+			req.result <- nil
+			h.neighbourcast(req.cli, nickChange(old, req.name))
+			h.federate(linkFrame{Type: "nick", From: old, To: req.name})
+
+		case pm := <-privates:
+			// 情况E: 私信 -> 只发给收信人，并给发信人一个回执
+			if h.muted(pm.from) {
+				continue
+			}
+			if strings.Contains(pm.to, "@") {
+				// 发给别的服务器上的人
+				h.sendRemote(pm.from, pm.to, pm.text)
+				continue
+			}
+			if _, ok := h.bots[pm.to]; ok {
+				// 发给机器人的私信
+				h.feedBots(private(pm.from.name, pm.to, pm.text, false))
+				pm.from.deliver(private(pm.from.name, pm.to, pm.text, true))
+				continue
+			}
+			to, ok := h.clients[pm.to]
+			if !ok {
+				pm.from.tell("没有这个用户: " + pm.to)
+				continue
+			}
+			to.deliver(private(pm.from.name, pm.to, pm.text, false))
+			if to != pm.from {
+				pm.from.deliver(private(pm.from.name, pm.to, pm.text, true))
+			}
+
+		case req := <-whos:
+			// 情况F: 查询在线名单（带房间名则只列这个房间的人）
+			h.who(req.cli, req.room)
+
+		case req := <-joins:
+			// 情况G: 加入或切换房间
+			h.join(req.cli, req.room)
+
+		case req := <-parts:
+			// 情况H: 离开房间
+			h.part(req.cli, req.room)
+
+		case cli := <-roomList:
+			// 情况I: 列出所有房间
+			h.listRooms(cli)
+
+		case q := <-currents:
+			// 情况J: 查询当前房间
+			q.reply <- q.cli.current
+
+		case q := <-names:
+			// 情况K: 查询昵称
+			q.reply <- q.cli.name
+
+		case req := <-mods:
+			// 情况L: 管理员命令
+			h.moderate(req)
+
+		case r := <-botReplies:
+			// 情况M: 机器人说话
+			h.botSay(r)
+
+		case up := <-linkUps:
+			// 情况N: 和另一台服务器连上了
+			up.result <- h.linkUp(up.l)
+
+		case l := <-linkDowns:
+			// 情况O: 和另一台服务器断开了（netsplit）
+			h.linkDown(l)
+
+		case e := <-linkFrames:
+			// 情况P: 另一台服务器转来的消息
+			h.relay(e.l, e.f)
 		}
 	}
 }
 
+// muted 判断 cli 是否正在被禁言，是的话提醒他，只能由 broadcaster 调用
+func (h *hub) muted(cli *client) bool {
+	if left := h.muteLeft(cli.name); left > 0 {
+		cli.tell(fmt.Sprintf("你被禁言了，还剩 %s", left.Round(time.Second)))
+		return true
+	}
+	return false
+}
+
 // handleConn 处理单个客户端的生命周期
+// 连接由 clientWriter 在发完最后一条消息后关闭
 func handleConn(conn net.Conn) {
-	ch := make(chan string)   // 创建该用户的专属消息通道
-	go clientWriter(conn, ch) // 启动子协程：专门负责把通道里的消息写回给客户端网络
+	ch := make(chan message, *queueSize) // 创建该用户的专属消息队列
+	cli := &client{ch: ch, conn: conn}
+	go clientWriter(cli) // 启动子协程：专门负责把通道里的消息写回给客户端网络
+
+	// 看门狗负责空闲超时和心跳（见 idle.go），它会往 ch 里写东西，
+	// 所以在注销或关闭 ch 之前必须先让它停下来
+	input := newLineReader(bufio.NewScanner(conn))
+	stop, done := make(chan struct{}), make(chan struct{})
+	go watchdog(cli, input, stop, done)
+	stopWatchdog := func() {
+		close(stop)
+		<-done
+	}
+
+	// 1. 握手：先要一个可用的昵称，成功后广播中心会通知所有人
+	if !handshake(cli, input) {
+		stopWatchdog()
+		close(ch) // 还没登记就断开了，通道由自己关闭
+		return
+	}
+	ch <- system("输入 /help 查看可用命令")
 
-	who := conn.RemoteAddr().String() // 获取用户 IP:Port
-	ch <- "你是: " + who                // 欢迎语（只发给自己）
-	messages <- who + " 来了"           // 广播通知所有人
-	entering <- ch                    // 向广播中心登记自己
+	// 2. 循环读取客户端发送过来的每一行文本，发得太快的行直接丢掉
+	limiter := newTokenBucket(*msgRate, *msgBurst)
+	for {
+		line, ref, ok := cli.next(input)
+		if !ok {
+			// 客户端断开、被看门狗断开、因为太慢被踢或者被管理员踢掉，都会走到这里
+			break
+		}
+		if !limiter.allow(time.Now()) {
+			ch <- system("发得太快了，这一行没有发出去")
+			cli.ackLater(ref)
+			continue
+		}
+		if strings.HasPrefix(line, "/") {
+			command(cli, line)
+			cli.ackLater(ref)
+			continue
+		}
+		messages <- chatMsg{cli, line, ref, ""} // 将用户说的话放入广播通道
+	}
+
+	stopWatchdog()
+	leaving <- cli // 向广播中心注销自己，它会通知所有人
+}
 
-	// 循环读取客户端发送过来的每一行文本
-	input := bufio.NewScanner(conn)
-	for input.Scan() {
-		messages <- who + ": " + input.Text() // 将用户说的话放入广播通道
+// handshake 反复询问昵称，直到登记成功或连接断开
+func handshake(cli *client, input *lineReader) bool {
+	for {
+		cli.ch <- system("请输入昵称:")
+		line, ref, ok := cli.next(input)
+		if !ok {
+			return false
+		}
+		if cmd, arg, _ := strings.Cut(line, " "); cmd == "/proto" {
+			// 登记之前就可以切换协议
+			cli.setProto(strings.TrimSpace(arg))
+			cli.ackLater(ref)
+			continue
+		}
+		entered, ok := enter(cli, input, strings.TrimSpace(line))
+		cli.ackLater(ref)
+		if !ok {
+			return false
+		}
+		if entered {
+			return true
+		}
 	}
-	// 注意：如果客户端断开连接，input.Scan() 会返回 false，循环结束
+}
 
-	leaving <- ch           // 向广播中心注销自己
-	messages <- who + " 走了" // 广播通知所有人
-	conn.Close()            // 关闭网络连接
+// enter 尝试用 name 登记，注册过的昵称先要密码
+// entered 表示登记成功；ok 为 false 表示等密码时连接断开了
+func enter(cli *client, input *lineReader, name string) (entered, ok bool) {
+	if err := validNick(name); err != nil {
+		cli.ch <- system(err.Error())
+		return false, true
+	}
+	if users.registered(name) {
+		// 注册过的昵称要先验证密码
+		cli.ch <- system("昵称 " + name + " 已注册，请输入密码:")
+		password, ref, ok := cli.next(input)
+		if !ok {
+			return false, false
+		}
+		defer cli.ackLater(ref)
+		if err := users.login(remoteIP(cli.conn), name, password); err != nil {
+			cli.ch <- system(err.Error())
+			return false, true
+		}
+	}
+	result := make(chan error)
+	entering <- nickRequest{cli, name, result} // 向广播中心登记自己
+	if err := <-result; err != nil {
+		cli.ch <- system(err.Error())
+		return false, true
+	}
+	return true, true
 }
 
-// clientWriter 专门负责向客户端写数据
-// 它遍历 channel，只要里面有数据，就通过网络发给用户
-func clientWriter(conn net.Conn, ch <-chan string) {
-	for msg := range ch {
-		fmt.Fprintln(conn, msg) // NOTE: 这里忽略了网络写入错误
+// command 处理以 / 开头的命令
+func command(cli *client, line string) {
+	cmd, rest, _ := strings.Cut(line, " ")
+	rest = strings.TrimSpace(rest)
+
+	switch cmd {
+	case "/nick":
+		if err := validNick(rest); err != nil {
+			cli.ch <- system(err.Error())
+			return
+		}
+		if users.registered(rest) {
+			cli.ch <- system("昵称 " + rest + " 已注册，请用 /login " + rest + " <密码>")
+			return
+		}
+		rename(cli, rest)
+
+	case "/register":
+		register(cli, rest)
+
+	case "/login":
+		name, password, _ := strings.Cut(rest, " ")
+		if users == nil {
+			cli.ch <- system("服务器没有开启账号功能")
+			return
+		}
+		if err := validNick(name); err != nil || password == "" {
+			cli.ch <- system("用法: /login <昵称> <密码>")
+			return
+		}
+		if err := users.login(remoteIP(cli.conn), name, password); err != nil {
+			cli.ch <- system(err.Error())
+			return
+		}
+		rename(cli, name)
+
+	case "/who":
+		whos <- roomRequest{cli, rest}
+
+	case "/join":
+		if err := validRoom(rest); err != nil {
+			cli.ch <- system(err.Error())
+			return
+		}
+		joins <- roomRequest{cli, rest}
+
+	case "/part":
+		if rest != "" {
+			if err := validRoom(rest); err != nil {
+				cli.ch <- system(err.Error())
+				return
+			}
+		}
+		parts <- roomRequest{cli, rest}
+
+	case "/rooms":
+		roomList <- cli
+
+	case "/proto":
+		cli.setProto(rest)
+
+	case "/kick", "/mute", "/unmute", "/ban", "/unban", "/bans":
+		mods <- modRequest{cli, cmd[1:], rest}
+
+	case "/history":
+		history(cli, rest)
+
+	case "/msg":
+		to, text, ok := strings.Cut(rest, " ")
+		if !ok || strings.TrimSpace(text) == "" {
+			cli.ch <- system("用法: /msg <昵称> <内容>")
+			return
+		}
+		privates <- privateMsg{cli, to, text}
+
+	case "/help":
+		cli.ch <- system("命令: /nick <新昵称>  /who [#房间]  /msg <昵称> <内容>  /join #房间  /part [#房间]  /rooms  /history [条数]  /register <密码>  /login <昵称> <密码>  /proto json|text  /help")
+		cli.ch <- system("管理员命令: /kick <昵称> [原因]  /mute <昵称> <时长>  /unmute <昵称>  /ban <IP或网段>  /unban <IP或网段>  /bans")
+
+	default:
+		cli.ch <- system("未知命令: " + cmd + "（输入 /help 查看可用命令）")
+	}
+}
+
+// rename 请 broadcaster 把 cli 改名为 name，失败时告诉用户原因
+func rename(cli *client, name string) {
+	result := make(chan error)
+	renames <- nickRequest{cli, name, result}
+	if err := <-result; err != nil {
+		cli.ch <- system(err.Error())
+	}
+}
+
+// register 把 cli 当前的昵称注册下来
+func register(cli *client, password string) {
+	if users == nil {
+		cli.ch <- system("服务器没有开启账号功能")
+		return
+	}
+	if password == "" {
+		cli.ch <- system("用法: /register <密码>")
+		return
+	}
+	reply := make(chan string)
+	names <- query{cli, reply}
+	name := <-reply
+	if ops[name] {
+		// 否则谁先连上来用管理员昵称注册，谁就成了管理员
+		cli.ch <- system("管理员昵称不能在线注册，请联系服务器管理员")
+		return
+	}
+	if err := users.register(name, password); err != nil {
+		cli.ch <- system(err.Error())
+		return
+	}
+	log.Printf("%s 注册了昵称 %s", remoteIP(cli.conn), name)
+	cli.ch <- system("昵称 " + name + " 注册成功，下次登录时需要输入密码")
+}
+
+// history 从磁盘上的聊天记录里读出当前房间最近的 n 条
+// 读文件在 handleConn 自己的 Goroutine 里做，不会拖慢 broadcaster
+func history(cli *client, arg string) {
+	if *transcriptPath == "" {
+		cli.ch <- system("服务器没有开启聊天记录")
+		return
+	}
+	n := 20
+	if arg != "" {
+		var err error
+		n, err = strconv.Atoi(arg)
+		if err != nil || n <= 0 || n > maxHistoryLines {
+			cli.ch <- system(fmt.Sprintf("用法: /history [1~%d]", maxHistoryLines))
+			return
+		}
+	}
+
+	reply := make(chan string)
+	currents <- query{cli, reply}
+	room := <-reply
+	if room == "" {
+		cli.ch <- system("你不在任何房间")
+		return
+	}
+
+	t := &transcript{path: *transcriptPath, keep: *transcriptKeep}
+	lines, err := t.tail(room, n)
+	if err != nil {
+		log.Printf("读聊天记录失败: %v", err)
+		cli.ch <- system("读取聊天记录失败")
+		return
+	}
+	cli.ch <- system(fmt.Sprintf("---- %s 的聊天记录（%d 条）----", room, len(lines)))
+	for _, line := range lines {
+		cli.ch <- system(line)
+	}
+	cli.ch <- system("---- 完 ----")
+}
+
+// validNick 检查昵称格式：1~20 个字符，不含空白，不以 / 或 # 开头
+func validNick(name string) error {
+	if name == "" || utf8.RuneCountInString(name) > 20 {
+		return fmt.Errorf("昵称长度必须是 1~20 个字符")
+	}
+	if strings.IndexFunc(name, unicode.IsSpace) >= 0 || strings.IndexFunc(name, unicode.IsControl) >= 0 {
+		return fmt.Errorf("昵称不能包含空白和控制字符")
+	}
+	if strings.HasPrefix(name, "/") || strings.HasPrefix(name, "#") {
+		return fmt.Errorf("昵称不能以 / 或 # 开头")
+	}
+	if strings.Contains(name, "@") {
+		return fmt.Errorf("昵称不能包含 @（别的服务器上的人显示成 昵称@服务器名）")
 	}
+	return nil
 }
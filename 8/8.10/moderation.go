@@ -0,0 +1,373 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --- 限流与管理 ---
+// 每个连接一个令牌桶：每秒补 -rate 个令牌，最多攒 -burst 个，每发一行（发言或命令）用掉一个，
+// 没有令牌的行直接丢掉并提醒发送者。令牌桶只由 handleConn 自己用，不需要锁。
+//
+// -ops 里列出的昵称是管理员，可以用:
+//
+//	/kick <昵称> [原因]     踢下线
+//	/mute <昵称> <时长>     禁言，例如 /mute bob 10m
+//	/unmute <昵称>
+//	/ban <IP 或网段>        封禁，同时踢掉这个地址上所有在线的人
+//	/unban <IP 或网段>
+//	/bans                   列出封禁名单
+//
+// 开启了账号功能时，管理员昵称必须是注册过的（登记时验证过密码），否则谁都能冒充。
+// 管理员昵称不能用 /register 在线注册，要事先写进账号文件；启动时会检查，缺了的打警告。
+// 禁言按昵称记在 hub 里，断线重连不会解除，禁言期间也不能改名；
+// 开启账号功能时注册过的昵称要密码才能用，禁言就等于落在了账号上。
+// 同一个 IP 后面可能是 NAT 或者代理后面的一大群人，所以禁言不按 IP 算，要按地址拦人请用 /ban。
+// 封禁名单保存在 -bans 文件里（一行一个），新连接 Accept 之后先查名单。
+
+var (
+	msgRate  = flag.Float64("rate", 2, "lines per second each connection may send (0 disables flood control)")
+	msgBurst = flag.Int("burst", 10, "lines a connection may send in a burst before -rate applies")
+	opsFlag  = flag.String("ops", "", "comma-separated nicknames with operator rights")
+	bansPath = flag.String("bans", "chat-bans.txt", "file holding banned IPs and CIDR ranges (empty keeps bans in memory only)")
+)
+
+// tokenBucket 是一个简单的令牌桶
+type tokenBucket struct {
+	rate   float64 // 每秒补充的令牌数
+	burst  float64 // 桶的容量
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	return &tokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+// allow 尝试取一个令牌；rate 为 0 表示不限流
+func (b *tokenBucket) allow(now time.Time) bool {
+	if b.rate <= 0 {
+		return true
+	}
+	b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// modRequest 是一条管理员命令，交给 broadcaster 执行
+type modRequest struct {
+	cli *client
+	cmd string // 不带 /，例如 "kick"
+	arg string
+}
+
+var mods = make(chan modRequest)
+
+// ops 是管理员昵称的集合，启动后只读
+var ops = make(map[string]bool)
+
+func parseOps(list string) {
+	for _, name := range strings.Split(list, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			ops[name] = true
+		}
+	}
+	if len(ops) > 0 && users == nil {
+		log.Printf("警告: 没有开启账号功能，任何人都可以用管理员昵称 %s 登记", strings.Join(sortedKeys(ops), ", "))
+		return
+	}
+	var missing []string
+	for _, name := range sortedKeys(ops) {
+		if !users.registered(name) {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		log.Printf("警告: 管理员昵称 %s 不在账号文件 %s 里，在补上之前没有管理权限"+
+			"（管理员昵称不能在线注册，可以先不带 -ops 启动，注册之后再重启）",
+			strings.Join(missing, ", "), *usersPath)
+	}
+}
+
+// isOp 判断 cli 是不是管理员
+// 注册过的昵称登记时一定验证过密码，所以开启账号功能时只认注册过的管理员昵称
+func isOp(cli *client) bool {
+	return ops[cli.name] && (users == nil || users.registered(cli.name))
+}
+
+// moderate 执行管理员命令，只能由 broadcaster 调用
+func (h *hub) moderate(req modRequest) {
+	cli := req.cli
+	if !isOp(cli) {
+		cli.tell("只有管理员才能使用 /" + req.cmd)
+		return
+	}
+	switch req.cmd {
+	case "kick":
+		name, reason, _ := strings.Cut(req.arg, " ")
+		target, ok := h.clients[name]
+		if !ok {
+			cli.tell("没有这个用户: " + name)
+			return
+		}
+		msg := name + " 被 " + cli.name + " 踢出了聊天室"
+		if reason = strings.TrimSpace(reason); reason != "" {
+			msg += "（" + reason + "）"
+		}
+		h.neighbourcast(target, system(msg))
+		if !sharesRoom(cli, target) {
+			cli.tell(msg) // 管理员和他不在同一个房间时，也要告诉管理员结果
+		}
+		h.disconnect(target)
+		log.Printf("%s 踢出了 %s (%s)", cli.name, name, target.conn.RemoteAddr())
+
+	case "unmute":
+		// 被禁言的人可能已经下线了，所以按禁言记录找，不要求他在线
+		if h.muteLeft(req.arg) <= 0 {
+			cli.tell(req.arg + " 没有被禁言")
+			return
+		}
+		delete(h.mutes, req.arg)
+		if target, ok := h.clients[req.arg]; ok {
+			target.tell("你被 " + cli.name + " 解除了禁言")
+		}
+		cli.tell("已解除 " + req.arg + " 的禁言")
+
+	case "mute":
+		name, arg, _ := strings.Cut(req.arg, " ")
+		target, ok := h.clients[name]
+		if !ok {
+			cli.tell("没有这个用户: " + name)
+			return
+		}
+		d, err := time.ParseDuration(strings.TrimSpace(arg))
+		if err != nil || d <= 0 {
+			cli.tell("用法: /mute <昵称> <时长>，例如 /mute bob 10m")
+			return
+		}
+		h.mutes[name] = time.Now().Add(d) // 已经被禁言的话重新计时
+		target.tell(fmt.Sprintf("你被 %s 禁言 %s", cli.name, d))
+		cli.tell(fmt.Sprintf("已禁言 %s %s", name, d))
+		log.Printf("%s 禁言了 %s %s", cli.name, name, d)
+
+	case "ban":
+		prefix, err := bans.add(req.arg)
+		if err != nil {
+			cli.tell(err.Error())
+			return
+		}
+		n := 0
+		for _, other := range h.clients {
+			if bans.banned(other.conn) {
+				other.tell("你的地址已被封禁")
+				h.disconnect(other)
+				n++
+			}
+		}
+		cli.tell(fmt.Sprintf("已封禁 %s，断开了 %d 个在线用户", prefix, n))
+		log.Printf("%s 封禁了 %s", cli.name, prefix)
+
+	case "unban":
+		if err := bans.remove(req.arg); err != nil {
+			cli.tell(err.Error())
+			return
+		}
+		cli.tell("已解除封禁 " + req.arg)
+		log.Printf("%s 解除了封禁 %s", cli.name, req.arg)
+
+	case "bans":
+		list := bans.list()
+		if len(list) == 0 {
+			cli.tell("封禁名单是空的")
+			return
+		}
+		cli.tell("封禁名单: " + strings.Join(list, ", "))
+	}
+}
+
+// sharesRoom 判断两个人是否至少同在一个房间（或者就是同一个人）
+func sharesRoom(a, b *client) bool {
+	if a == b {
+		return true
+	}
+	for room := range a.rooms {
+		if b.rooms[room] {
+			return true
+		}
+	}
+	return false
+}
+
+// disconnect 让 cli 的读循环马上结束，照常走 leaving 流程
+// 用读截止时间而不是直接关连接，这样已经排队的提示还能由 clientWriter 发出去
+func (h *hub) disconnect(cli *client) {
+	cli.conn.SetReadDeadline(time.Now())
+}
+
+// muteLeft 返回昵称 name 的禁言还剩多久，没有被禁言时返回 0，只能由 broadcaster 调用
+// 到期的记录顺手删掉
+func (h *hub) muteLeft(name string) time.Duration {
+	until, ok := h.mutes[name]
+	if !ok {
+		return 0
+	}
+	left := time.Until(until)
+	if left <= 0 {
+		delete(h.mutes, name)
+	}
+	return max(left, 0)
+}
+
+// bans 是全局的封禁名单
+var bans *banList
+
+// banList 是封禁的地址段，Accept 的 Goroutine 和 broadcaster 都会用，所以要加锁
+type banList struct {
+	path string // 为空表示不保存
+
+	mu       sync.Mutex
+	prefixes map[netip.Prefix]bool
+}
+
+// loadBans 读入封禁名单，文件不存在时从空名单开始
+func loadBans(path string) (*banList, error) {
+	b := &banList{path: path, prefixes: make(map[netip.Prefix]bool)}
+	if path == "" {
+		return b, nil
+	}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return b, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	input := bufio.NewScanner(f)
+	for n := 1; input.Scan(); n++ {
+		s := strings.TrimSpace(input.Text())
+		if s == "" || strings.HasPrefix(s, "#") {
+			continue
+		}
+		p, err := parsePrefix(s)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, n, err)
+		}
+		b.prefixes[p] = true
+	}
+	return b, input.Err()
+}
+
+// parsePrefix 接受单个 IP 或 CIDR 网段
+func parsePrefix(s string) (netip.Prefix, error) {
+	s = strings.TrimSpace(s)
+	if strings.Contains(s, "/") {
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			return netip.Prefix{}, fmt.Errorf("无效的网段: %q", s)
+		}
+		return p.Masked(), nil
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("无效的 IP: %q", s)
+	}
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// banned 判断连接的对端地址是否在封禁名单里
+func (b *banList) banned(conn net.Conn) bool {
+	return b.bannedIP(remoteIP(conn))
+}
+
+// bannedIP 判断 ip 是否在封禁名单里
+func (b *banList) bannedIP(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for p := range b.prefixes {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *banList) add(s string) (netip.Prefix, error) {
+	p, err := parsePrefix(s)
+	if err != nil {
+		return p, err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.prefixes[p] = true
+	b.save()
+	return p, nil
+}
+
+func (b *banList) remove(s string) error {
+	p, err := parsePrefix(s)
+	if err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.prefixes[p] {
+		return fmt.Errorf("%s 不在封禁名单里", p)
+	}
+	delete(b.prefixes, p)
+	b.save()
+	return nil
+}
+
+func (b *banList) list() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var list []string
+	for p := range b.prefixes {
+		list = append(list, p.String())
+	}
+	sort.Strings(list)
+	return list
+}
+
+// save 把名单整个写到临时文件再改名，写到一半崩溃也不会留下半个文件
+// 写失败只记日志：内存里的名单已经生效了
+// 注意：调用者必须已经持有 b.mu
+func (b *banList) save() {
+	if b.path == "" {
+		return
+	}
+	var sb strings.Builder
+	for p := range b.prefixes {
+		sb.WriteString(p.String() + "\n")
+	}
+	tmp := b.path + ".tmp"
+	err := os.WriteFile(tmp, []byte(sb.String()), 0o644)
+	if err == nil {
+		err = os.Rename(tmp, b.path)
+	}
+	if err != nil {
+		log.Printf("保存封禁名单失败: %v", err)
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"sync/atomic"
+	"time"
+	"unicode"
+)
+
+// --- 消息格式 ---
+// 服务器发给客户端的每条消息都是一个 message。默认按纯文本发送（一行一条，
+// 和以前一模一样，nc 和 telnet 照样能用）；客户端发一行 "/proto json" 之后，
+// 这个连接就改成 JSON Lines，每行一个 message 对象:
+//
+//	{"id":42,"time":"2026-01-02T15:04:05Z","type":"chat","room":"#lobby","from":"alice","text":"hi"}
+//
+// type 的取值:
+//
+//	welcome  登记成功，to 是你的昵称
+//	chat     房间里的发言（history 为 true 表示是加入房间时回放的旧消息）
+//	join     有人加入房间，from 是这个人；from 是自己时 names 是房间里现在的所有人
+//	leave    有人离开房间或下线，from 是这个人（quit 为 true 表示下线）
+//	nick     改名，from 是旧昵称、to 是新昵称
+//	private  私信，from 是发信人、to 是收信人（发信人自己也会收到一份）
+//	system   其他提示、命令结果、错误（/who 的结果带 names，查的是某个房间时还带 room）
+//	ping     心跳，text 是 "PING <n>"，客户端回一行 "PONG <n>"（不用 JSON）
+//	ack      确认：ref 是客户端那一行的 id；发言的确认里 id 就是这条发言的消息号
+//
+// JSON 模式下客户端每行发一个 {"id":"c1","text":"..."}，text 就是纯文本模式下
+// 会输入的那一行（发言或 / 命令）；带了 id 的行处理完之后服务器会回一个 ack。
+// 发言的 ack 一定排在这条发言的广播之后；命令的结果由 broadcaster 发出，可能比 ack 晚到。
+// "/proto text" 切回纯文本。
+
+// lastID 是最近分配的消息号，所有连接共用
+var lastID atomic.Int64
+
+type message struct {
+	ID      int64     `json:"id"`
+	Time    time.Time `json:"time"`
+	Type    string    `json:"type"`
+	Room    string    `json:"room,omitempty"`
+	From    string    `json:"from,omitempty"`
+	To      string    `json:"to,omitempty"`
+	Text    string    `json:"text,omitempty"`
+	Ref     string    `json:"ref,omitempty"`
+	History bool      `json:"history,omitempty"`
+	Quit    bool      `json:"quit,omitempty"`
+	Names   []string  `json:"names,omitempty"`
+
+	plain    string // 纯文本模式下发出去的那一行，为空时用 Text
+	jsonLine string // 预先编好的 JSON（见 precoded），为空时现编
+}
+
+// newMessage 分配消息号并打上服务器时间
+func newMessage(typ, text string) message {
+	return message{ID: lastID.Add(1), Time: time.Now().UTC(), Type: typ, Text: text}
+}
+
+// system 是一条普通提示
+func system(text string) message {
+	return newMessage("system", text)
+}
+
+// welcome 是登记成功后发给自己的欢迎语
+func welcome(name string) message {
+	m := newMessage("welcome", "你是: "+name)
+	m.To = name
+	return m
+}
+
+// chat 是 from 在 room 里的一条发言
+func chat(room, from, text string) message {
+	m := newMessage("chat", text)
+	m.Room, m.From = room, from
+	m.plain = "[" + room + "] " + from + ": " + text
+	return m
+}
+
+// roomEvent 是 who 加入（join）或离开（leave）room 的通知，text 是给人看的说明
+func roomEvent(typ, room, who, text string) message {
+	m := newMessage(typ, text)
+	m.Room, m.From = room, who
+	m.plain = "[" + room + "] " + text
+	return m
+}
+
+// nickChange 是 old 改名为 new 的通知
+func nickChange(old, new string) message {
+	m := newMessage("nick", old+" 改名为 "+new)
+	m.From, m.To = old, new
+	return m
+}
+
+// private 是一条私信；sent 为 true 时是发给发信人自己的回执
+func private(from, to, text string, sent bool) message {
+	m := newMessage("private", text)
+	m.From, m.To = from, to
+	if sent {
+		m.plain = "[私信 -> " + to + "] " + text
+	} else {
+		m.plain = "[私信] " + from + ": " + text
+	}
+	return m
+}
+
+// ack 确认客户端 id 为 ref 的那一行已经处理完
+func ack(ref string) message {
+	m := newMessage("ack", "")
+	m.Ref = ref
+	return m
+}
+
+// replay 把 backlog 里的一条发言包装成回放消息，保留原来的消息号和时间
+func (m message) replay() message {
+	m.History = true
+	m.plain = "[" + m.Room + "] " + m.Time.Local().Format("15:04:05") + " " + m.From + ": " + m.Text
+	return m
+}
+
+// precoded 返回预先编好 JSON 的副本
+// 要发给很多人的消息在 broadcaster 里编一次，所有 JSON 连接共用，不用每个 clientWriter 各编一次；
+// 副本发出去之后就不能再改它的字段了
+func (m message) precoded() message {
+	b, _ := json.Marshal(m)
+	m.jsonLine = string(b)
+	return m
+}
+
+// encode 按连接的模式把消息变成一行（不含换行符）；纯文本模式下 ack 不发，返回 false
+func (m message) encode(asJSON bool) (string, bool) {
+	if asJSON && m.jsonLine != "" {
+		return m.jsonLine, true
+	}
+	if asJSON {
+		b, _ := json.Marshal(m)
+		return string(b), true
+	}
+	if m.Type == "ack" {
+		return "", false
+	}
+	if m.plain != "" {
+		return m.plain, true
+	}
+	return m.Text, true
+}
+
+// encode 按连接的协议把消息变成要发出去的若干行（不含行尾）
+func (cli *client) encode(m message) []string {
+	if cli.irc != nil {
+		return cli.irc.encode(m)
+	}
+	if line, ok := m.encode(cli.json.Load()); ok {
+		return []string{line}
+	}
+	return nil
+}
+
+// eol 是这个连接的行尾，IRC 规定用 CRLF
+func (cli *client) eol() string {
+	if cli.irc != nil {
+		return "\r\n"
+	}
+	return "\n"
+}
+
+// clientLine 是 JSON 模式下客户端发来的一行
+type clientLine struct {
+	ID   string `json:"id"`
+	Text string `json:"text"`
+}
+
+// decode 按连接的模式解析客户端发来的一行，返回要处理的文本和要确认的 id
+// JSON 模式下不是 { 开头的行仍按纯文本处理（例如 PONG）；解析失败返回 false
+func (cli *client) decode(line string) (text, ref string, ok bool) {
+	if !cli.json.Load() || !strings.HasPrefix(line, "{") {
+		return line, "", true
+	}
+	var in clientLine
+	if err := json.Unmarshal([]byte(line), &in); err != nil {
+		return "", "", false
+	}
+	return in.Text, in.ID, true
+}
+
+// next 读取并解析下一行，跳过解析不了的行；连接断开时返回 false
+func (cli *client) next(input *lineReader) (text, ref string, ok bool) {
+	for {
+		line, ok := input.next()
+		if !ok {
+			return "", "", false
+		}
+		if text, ref, ok := cli.decode(line); ok {
+			return cleanText(text), ref, true
+		}
+		cli.ch <- system("无法解析的 JSON: " + cleanText(line))
+	}
+}
+
+// cleanText 去掉客户端发来的文本里的控制字符（CR、LF、ESC 等），制表符换成空格
+// 否则 JSON 里的 "\r\n" 能在别人那里伪造出整行消息（IRC 连接、纯文本连接、聊天记录都会中招），
+// ANSI 转义序列还能搞乱别人的终端
+func cleanText(s string) string {
+	if strings.IndexFunc(s, unicode.IsControl) < 0 {
+		return s
+	}
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r == '\t':
+			return ' '
+		case unicode.IsControl(r):
+			return -1
+		}
+		return r
+	}, s)
+}
+
+// ackLater 在 handleConn 处理完一行之后确认它，ref 为空时什么都不做
+func (cli *client) ackLater(ref string) {
+	if ref != "" {
+		cli.ch <- ack(ref)
+	}
+}
+
+// setProto 处理 "/proto json|text"
+func (cli *client) setProto(arg string) {
+	switch arg {
+	case "json":
+		cli.json.Store(true)
+		cli.ch <- system("协议切换为 json")
+	case "text":
+		cli.json.Store(false)
+		cli.ch <- system("协议切换为 text")
+	default:
+		cli.ch <- system("用法: /proto json|text")
+	}
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// defaultRoom 是新用户连上后自动加入的房间
+const defaultRoom = "#lobby"
+
+// hub 是 broadcaster 私有的状态：在线用户和房间
+// 房间在第一个人加入时创建，最后一个人离开时删除；
+// 但房间最近的发言（backlog）会一直留着，房间重新建起来时还能回放
+type hub struct {
+	clients    map[string]*client          // 昵称 -> 在线用户
+	rooms      map[string]map[*client]bool // 房间名 -> 成员
+	backlog    map[string][]message        // 房间名 -> 最近的发言，最多 -history 条（见 transcript.go）
+	transcript *transcript                 // 磁盘上的聊天记录，nil 表示不记录
+	bots       map[string]*botRunner       // 昵称 -> 机器人（见 bots.go）
+	fed        *federation                 // 和其他服务器的互联（见 federation.go）
+	mutes      map[string]time.Time        // 昵称 -> 被禁言到这个时间（见 moderation.go）
+}
+
+func newHub(tr *transcript, bots map[string]*botRunner) *hub {
+	return &hub{
+		clients:    make(map[string]*client),
+		rooms:      make(map[string]map[*client]bool),
+		backlog:    make(map[string][]message),
+		transcript: tr,
+		bots:       bots,
+		fed:        newFederation(),
+		mutes:      make(map[string]time.Time),
+	}
+}
+
+// nickTaken 判断昵称是否已经被在线用户或者机器人占用
+func (h *hub) nickTaken(name string) bool {
+	_, online := h.clients[name]
+	_, bot := h.bots[name]
+	return online || bot
+}
+
+// roomcast 把一条消息发给房间里的所有人
+// 不止一个人时先把 JSON 编好（见 precoded），调用者手里的 msg 不受影响
+func (h *hub) roomcast(room string, msg message) {
+	members := h.rooms[room]
+	if len(members) > 1 {
+		msg = msg.precoded()
+	}
+	for cli := range members {
+		cli.deliver(msg) // 把消息塞入每个用户的专属通道
+	}
+}
+
+// say 是本服务器上的人（或机器人）在房间里的一条发言：
+// 在本地发出去、交给机器人、发给互联的服务器，返回它的消息号
+func (h *hub) say(room, from, text string) int64 {
+	msg := chat(room, from, text)
+	h.post(msg)
+	h.feedBots(msg)
+	h.federate(linkFrame{Type: "chat", Room: room, From: from, Text: text, Time: msg.Time})
+	return msg.ID
+}
+
+// post 把一条发言广播给房间里的人、写进聊天记录、放进 backlog
+// 别的服务器转来的发言只走这一步
+func (h *hub) post(msg message) {
+	room := msg.Room
+	h.roomcast(room, msg)
+	h.transcript.record(room, msg.From+": "+msg.Text)
+
+	if *historySize > 0 {
+		b := append(h.backlog[room], msg)
+		if len(b) > *historySize {
+			b = b[len(b)-*historySize:]
+		}
+		h.backlog[room] = b
+	}
+}
+
+// notice 是 who 加入（join）或离开（leave）房间的通知，广播并写进聊天记录，但不回放
+func (h *hub) notice(typ, room, who, text string) {
+	msg := roomEvent(typ, room, who, text)
+	h.roomcast(room, msg)
+	h.transcript.record(room, "* "+text)
+	h.feedBots(msg)
+}
+
+// neighbourcast 把一条消息发给和 cli 同在任意一个房间的人（包括 cli 自己），每人只发一次
+func (h *hub) neighbourcast(cli *client, msg message) {
+	sent := map[*client]bool{cli: true}
+	cli.deliver(msg)
+	for room := range cli.rooms {
+		h.transcript.record(room, "* "+msg.Text)
+		for other := range h.rooms[room] {
+			if !sent[other] {
+				sent[other] = true
+				other.deliver(msg)
+			}
+		}
+	}
+}
+
+// join 把 cli 加入房间并设为当前房间；已经在里面的话只切换当前房间
+func (h *hub) join(cli *client, room string) {
+	cli.current = room
+	if cli.rooms[room] {
+		cli.tell("当前房间切换到 " + room)
+		return
+	}
+	members, ok := h.rooms[room]
+	if !ok {
+		members = make(map[*client]bool)
+		h.rooms[room] = members
+	}
+	h.notice("join", room, cli.name, cli.name+" 加入了") // 先通知房间里原来的人，再把自己加进去
+	members[cli] = true
+	cli.rooms[room] = true
+	h.federate(linkFrame{Type: "join", Room: room, From: cli.name})
+	names := h.roomNames(room)
+	joined := roomEvent("join", room, cli.name, fmt.Sprintf("你加入了 %s（%d 人），当前房间是 %s", room, len(names), room))
+	joined.plain = joined.Text
+	joined.Names = names
+	cli.deliver(joined)
+
+	// 回放这个房间最近的发言
+	if b := h.backlog[room]; len(b) > 0 {
+		cli.tell(fmt.Sprintf("---- %s 最近 %d 条消息 ----", room, len(b)))
+		for _, msg := range b {
+			cli.deliver(msg.replay())
+		}
+		cli.tell("---- 以上是历史消息 ----")
+	}
+}
+
+// part 让 cli 离开房间，room 为空表示离开当前房间
+func (h *hub) part(cli *client, room string) {
+	if room == "" {
+		room = cli.current
+	}
+	if !cli.rooms[room] {
+		cli.tell("你不在房间 " + room + " 里")
+		return
+	}
+	h.leave(cli, room, cli.name+" 离开了", false)
+	left := roomEvent("leave", room, cli.name, "你离开了 "+room)
+	left.plain = left.Text
+	cli.deliver(left)
+
+	// 离开的是当前房间，就随便切到另一个还在的房间（按名字排第一个）
+	if cli.current == room {
+		cli.current = ""
+		for _, r := range sortedKeys(cli.rooms) {
+			cli.current = r
+			cli.tell("当前房间切换到 " + r)
+			break
+		}
+	}
+}
+
+// partAll 让 cli 离开所有房间，断线时调用
+func (h *hub) partAll(cli *client, msg string) {
+	for room := range cli.rooms {
+		h.leave(cli, room, msg, true)
+	}
+	cli.current = ""
+}
+
+// leave 把 cli 移出房间并通知剩下的人，房间空了就删掉；quit 表示他是下线了
+func (h *hub) leave(cli *client, room, msg string, quit bool) {
+	h.federate(linkFrame{Type: "leave", Room: room, From: cli.name, Quit: quit})
+	delete(cli.rooms, room)
+	members := h.rooms[room]
+	delete(members, cli)
+	if len(members) == 0 {
+		delete(h.rooms, room)
+		h.transcript.record(room, "* "+msg)
+		return
+	}
+	left := roomEvent("leave", room, cli.name, msg)
+	left.Quit = quit
+	h.roomcast(room, left)
+	h.transcript.record(room, "* "+msg)
+	h.feedBots(left)
+}
+
+// who 列出在线用户，room 不为空时只列这个房间的成员
+func (h *hub) who(cli *client, room string) {
+	var names []string
+	if room == "" {
+		names = append(sortedKeys(h.clients), h.remoteNames("")...)
+		sort.Strings(names)
+	} else {
+		names = h.roomNames(room)
+	}
+
+	where := "在线"
+	if room != "" {
+		where = room
+	}
+	m := system(fmt.Sprintf("%s %d 人: %s", where, len(names), strings.Join(names, ", ")))
+	m.Room, m.Names = room, names
+	cli.deliver(m)
+}
+
+// roomNames 返回房间里所有人的昵称，包括别的服务器上的（见 federation.go），排好序
+func (h *hub) roomNames(room string) []string {
+	names := append(memberNames(h.rooms[room]), h.remoteNames(room)...)
+	sort.Strings(names)
+	return names
+}
+
+// memberNames 返回房间成员的昵称，排好序
+func memberNames(members map[*client]bool) []string {
+	names := make([]string, 0, len(members))
+	for member := range members {
+		names = append(names, member.name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// listRooms 列出所有房间和人数
+func (h *hub) listRooms(cli *client) {
+	if len(h.rooms) == 0 {
+		cli.tell("现在没有任何房间")
+		return
+	}
+	var b strings.Builder
+	b.WriteString("房间:")
+	for _, room := range sortedKeys(h.rooms) {
+		fmt.Fprintf(&b, " %s(%d)", room, len(h.rooms[room]))
+	}
+	cli.tell(b.String())
+}
+
+// sortedKeys 返回 map 的键并排好序，让输出顺序稳定
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// validRoom 检查房间名格式：以 # 开头，2~30 个字符，不含空白
+func validRoom(room string) error {
+	if !strings.HasPrefix(room, "#") {
+		return fmt.Errorf("房间名必须以 # 开头")
+	}
+	if n := utf8.RuneCountInString(room); n < 2 || n > 30 {
+		return fmt.Errorf("房间名长度必须是 2~30 个字符")
+	}
+	if strings.IndexFunc(room, unicode.IsSpace) >= 0 {
+		return fmt.Errorf("房间名不能包含空白")
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"log"
+	"net"
+	"time"
+)
+
+// --- 慢客户端保护 ---
+// 每个用户的消息通道都是有界的队列（-queue 条）。broadcaster 投递时从不阻塞：
+// 队列满了说明这个用户读得太慢，按 -slow 指定的策略处理:
+//
+//	drop  丢掉队列里最旧的一条，腾出位置给新消息（默认）
+//	kick  直接断开这个用户
+//
+// clientWriter 每次写网络都设截止时间（-write-timeout），写失败就关闭连接，
+// 然后把队列里剩下的消息丢掉，保证任何人往通道里塞消息都不会永远卡住。
+
+var (
+	queueSize    = flag.Int("queue", 64, "per-client outgoing queue length")
+	slowPolicy   = flag.String("slow", "drop", "what to do when a client's queue is full: drop (oldest) or kick")
+	writeTimeout = flag.Duration("write-timeout", 10*time.Second, "deadline for each network write to a client")
+)
+
+// deliver 把消息放进用户的队列，队列满时按 -slow 策略处理，绝不阻塞
+// 只能由 broadcaster 调用（它是唯一会读写 dropped、kicked 的 Goroutine）
+func (cli *client) deliver(msg message) {
+	if cli.kicked {
+		return // 已经被踢了，等它走完 leaving 流程
+	}
+	select {
+	case cli.ch <- msg:
+		return
+	default:
+	}
+
+	if *slowPolicy == "kick" {
+		cli.kicked = true
+		log.Printf("%s (%s) 读得太慢，断开连接", cli.name, cli.conn.RemoteAddr())
+		cli.conn.Close() // handleConn 的读循环会因此结束，照常走 leaving 流程
+		return
+	}
+
+	// drop：丢掉最旧的一条（clientWriter 可能刚好取走了它，那就不用丢了）
+	select {
+	case <-cli.ch:
+		cli.dropped++
+	default:
+	}
+	select {
+	case cli.ch <- msg:
+	default:
+		cli.dropped++
+	}
+	if cli.dropped%100 == 1 {
+		log.Printf("%s (%s) 读得太慢，已丢弃 %d 条消息", cli.name, cli.conn.RemoteAddr(), cli.dropped)
+	}
+}
+
+// tell 投递一条 system 提示，同样只能由 broadcaster 调用
+func (cli *client) tell(text string) {
+	cli.deliver(system(text))
+}
+
+// clientWriter 专门负责向客户端写数据
+// 它遍历 channel，只要里面有数据，就通过网络发给用户
+// 队列里积压了多条时先攒进缓冲区，队列空了再一次性写出去，减少系统调用
+// 任何一次写入失败或超时都会关闭连接，之后只是把通道排空，直到 broadcaster 关闭它
+// 通道被关闭（用户已经注销）时，把剩下的消息发完再关闭连接
+// 每条消息按这个连接当时的协议（纯文本、JSON 或 IRC）编码
+func clientWriter(cli *client) {
+	conn, ch := cli.conn, cli.ch
+	defer conn.Close()
+
+	w := bufio.NewWriter(conn)
+	for msg := range ch {
+		if w.Buffered() == 0 {
+			// 每一批设一次截止时间就够了：人多的房间里每行都设一次，开销能占到写数据的一成
+			conn.SetWriteDeadline(time.Now().Add(*writeTimeout))
+		}
+		for _, line := range cli.encode(msg) {
+			w.WriteString(line)
+			w.WriteString(cli.eol())
+		}
+		if len(ch) > 0 || w.Buffered() == 0 {
+			continue // 后面还有（或者没什么可写的），先不急着写
+		}
+		if err := w.Flush(); err != nil {
+			if !errors.Is(err, net.ErrClosed) { // 被踢或心跳超时时连接已经关了，不用再报
+				log.Printf("写入 %s 失败: %v", conn.RemoteAddr(), err)
+			}
+			conn.Close() // handleConn 的读循环会因此结束
+			break
+		}
+	}
+	for range ch {
+		// 连接已经坏了，丢掉剩下的消息
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 测试共用一个 broadcaster；队列调小，慢客户端几条消息就能把它塞满，
+// 写超时调大，保证断开它的是 -slow 策略而不是 clientWriter 的写超时；
+// 关掉历史回放，免得前一个测试的发言在后一个测试里把新加入的人的队列塞满
+func TestMain(m *testing.M) {
+	*queueSize = 16
+	*historySize = 0
+	*writeTimeout = time.Minute
+	*msgRate = 0
+	go broadcaster(nil, nil)
+	os.Exit(m.Run())
+}
+
+// peer 是测试这一端的连接
+type peer struct {
+	conn  net.Conn
+	input *bufio.Scanner
+}
+
+// dial 用 net.Pipe 连上服务器并登记 name；stalled 为 true 时登记完就再也不读
+func dial(t *testing.T, name string, stalled bool) *peer {
+	t.Helper()
+	client, server := net.Pipe()
+	go handleConn(server)
+	t.Cleanup(func() { hangUp(client, server) })
+	p := &peer{conn: client, input: bufio.NewScanner(client)}
+	if stalled {
+		// net.Pipe 没有缓冲，服务器写的第一行（请输入昵称）就会卡住，之后全堆在队列里
+		fmt.Fprintln(client, name)
+		return p
+	}
+	p.waitFor(t, "请输入昵称")
+	fmt.Fprintln(client, name)
+	p.waitFor(t, "输入 /help")
+	return p
+}
+
+// hangUp 像管理员踢人一样让服务器那头的读循环结束，再把发给 client 的东西读完，
+// 直到 clientWriter 关掉连接。那时 broadcaster 已经注销了这个人，
+// 下一个测试改 -slow 之类的参数就不会和它处理这个人离开的过程同时发生
+func hangUp(client, server net.Conn) {
+	server.SetReadDeadline(time.Now())
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	io.Copy(io.Discard, client)
+	client.Close()
+}
+
+// say 发一行
+func (p *peer) say(t *testing.T, line string) {
+	t.Helper()
+	p.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	if _, err := fmt.Fprintln(p.conn, line); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// waitFor 一直读到包含 want 的一行
+func (p *peer) waitFor(t *testing.T, want string) string {
+	t.Helper()
+	p.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for p.input.Scan() {
+		if line := p.input.Text(); strings.Contains(line, want) {
+			return line
+		}
+	}
+	t.Fatalf("没等到 %q: %v", want, p.input.Err())
+	return ""
+}
+
+// flood 让 talker 发 n 条，每条都等 talker 自己和 reader 收到再发下一条，
+// 这样正常读的人队列里最多积压一两条，塞满的只会是那个不读的
+func flood(t *testing.T, talker, reader *peer, n int) {
+	t.Helper()
+	for i := range n {
+		text := fmt.Sprintf("flood %d.", i)
+		talker.say(t, text)
+		talker.waitFor(t, text)
+		reader.waitFor(t, text)
+	}
+}
+
+func TestStalledClientDrop(t *testing.T) {
+	*slowPolicy = "drop"
+	alice := dial(t, "alice1", false)
+	dial(t, "stalled1", true)
+	bob := dial(t, "bob1", false)
+	alice.waitFor(t, "bob1 加入了")
+
+	flood(t, bob, alice, 3**queueSize)
+
+	// 丢的是它自己的旧消息，人还在线
+	bob.say(t, "/who")
+	if line := bob.waitFor(t, "在线"); !strings.Contains(line, "stalled1") {
+		t.Errorf("不读的客户端在 drop 策略下不应该被断开: %s", line)
+	}
+}
+
+func TestStalledClientKick(t *testing.T) {
+	*slowPolicy = "kick"
+	alice := dial(t, "alice2", false)
+	stalled := dial(t, "stalled2", true)
+	bob := dial(t, "bob2", false)
+	alice.waitFor(t, "bob2 加入了")
+
+	flood(t, bob, alice, 3**queueSize)
+	waitKicked(t, stalled, bob, "stalled2")
+}
+
+// WebSocket 连接的 clientWriter 卡在写上时还拿着 wsConn 的锁，
+// broadcaster 踢人时不能等这把锁，否则整个服务器都要等到写超时
+func TestStalledWebSocketKick(t *testing.T) {
+	*slowPolicy = "kick"
+	alice := dial(t, "alice3", false)
+	stalled := dialWebSocket(t, "stalled3")
+	bob := dial(t, "bob3", false)
+	alice.waitFor(t, "bob3 加入了")
+
+	flood(t, bob, alice, 3**queueSize)
+	waitKicked(t, stalled, bob, "stalled3")
+}
+
+// dialWebSocket 用 net.Pipe 模拟一个已经握手完的 WebSocket 连接，登记 name 之后再也不读
+func dialWebSocket(t *testing.T, name string) *peer {
+	t.Helper()
+	client, server := net.Pipe()
+	go handleConn(&wsConn{Conn: server, r: bufio.NewReader(server)})
+	t.Cleanup(func() { hangUp(client, server) })
+	// 客户端的帧必须带掩码，掩码全 0 时内容不用变换
+	client.Write(append([]byte{0x80 | wsOpText, 0x80 | byte(len(name)), 0, 0, 0, 0}, name...))
+	return &peer{conn: client}
+}
+
+// waitKicked 等 stalled 被服务器断开，并且从 observer 看到的在线名单里消失
+func waitKicked(t *testing.T, stalled, observer *peer, name string) {
+	t.Helper()
+	// 服务器关掉了它的连接，这头会读到 EOF
+	stalled.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.Copy(io.Discard, stalled.conn); err != nil {
+		t.Fatalf("不读的客户端在 kick 策略下应该被断开: %v", err)
+	}
+	// 注销是异步的，等它从在线名单里消失
+	for range 100 {
+		observer.say(t, "/who")
+		if line := observer.waitFor(t, "在线"); !strings.Contains(line, name) {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Error("被踢掉的客户端一直留在在线名单里")
+}
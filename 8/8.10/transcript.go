@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// --- 聊天记录 ---
+// 两层记录:
+//  1. 内存里每个房间保留最近 -history 条发言，有人加入房间时先回放给他；
+//  2. 所有房间里的发言和进出都带时间戳追加到 -transcript 文件，
+//     文件超过 -transcript-max 字节就轮转成 .1、.2 ……，最多保留 -transcript-keep 个旧文件。
+//
+// /history [n] 从磁盘上读回当前房间最近 n 条记录。
+// 写文件在单独的 Goroutine 里做，broadcaster 只负责把行丢进通道；通道满了（磁盘卡住）就丢掉这一行并计数。
+
+var (
+	historySize    = flag.Int("history", 50, "messages per room replayed to people who join (0 disables)")
+	transcriptPath = flag.String("transcript", "chat-transcript.log", "append every room message to this file (empty disables)")
+	transcriptMax  = flag.Int64("transcript-max", 10<<20, "rotate the transcript when it grows past this many bytes")
+	transcriptKeep = flag.Int("transcript-keep", 5, "number of rotated transcript files to keep")
+)
+
+const maxHistoryLines = 500 // /history 一次最多读回的行数
+
+// transcript 是带轮转的聊天记录文件
+type transcript struct {
+	path    string
+	maxSize int64
+	keep    int
+	lines   chan string // broadcaster 往里丢格式化好的行，run 负责写盘
+	dropped int         // 因为磁盘跟不上、队列满了而没记下的行数，只由 broadcaster 读写
+
+	f    *os.File // 下面两个字段只由 run 所在的 Goroutine 访问
+	size int64
+}
+
+// openTranscript 打开（或创建）记录文件，并启动写盘 Goroutine
+func openTranscript(path string, maxSize int64, keep int) (*transcript, error) {
+	t := &transcript{path: path, maxSize: maxSize, keep: keep, lines: make(chan string, 1024)}
+	if err := t.open(); err != nil {
+		return nil, err
+	}
+	go t.run()
+	return t, nil
+}
+
+func (t *transcript) open() error {
+	f, err := os.OpenFile(t.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	t.f, t.size = f, info.Size()
+	return nil
+}
+
+// record 记下房间里的一行，格式为 "2006-01-02T15:04:05Z07:00 #room text"
+// 可以安全地传入 nil（表示没有开启记录）
+// 磁盘卡住时队列会满，这时直接丢掉这一行，不能让 broadcaster 跟着卡住
+func (t *transcript) record(room, text string) {
+	if t == nil {
+		return
+	}
+	select {
+	case t.lines <- time.Now().Format(time.RFC3339) + " " + room + " " + text + "\n":
+	default:
+		t.dropped++
+		if t.dropped%100 == 1 {
+			log.Printf("写聊天记录跟不上，已丢弃 %d 行", t.dropped)
+		}
+	}
+}
+
+func (t *transcript) run() {
+	for line := range t.lines {
+		if t.size+int64(len(line)) > t.maxSize && t.size > 0 {
+			if err := t.rotate(); err != nil {
+				log.Printf("聊天记录轮转失败: %v", err)
+			}
+		}
+		n, err := t.f.WriteString(line)
+		t.size += int64(n)
+		if err != nil {
+			log.Printf("写聊天记录失败: %v", err)
+		}
+	}
+}
+
+// rotate 把 path 改名为 path.1，原来的 path.1 改名为 path.2，以此类推
+func (t *transcript) rotate() error {
+	t.f.Close()
+	os.Remove(t.rotated(t.keep)) // 最旧的一个不要了
+	for i := t.keep - 1; i >= 1; i-- {
+		os.Rename(t.rotated(i), t.rotated(i+1))
+	}
+	if t.keep > 0 {
+		if err := os.Rename(t.path, t.rotated(1)); err != nil {
+			return err
+		}
+	} else {
+		os.Remove(t.path)
+	}
+	return t.open()
+}
+
+func (t *transcript) rotated(i int) string {
+	return fmt.Sprintf("%s.%d", t.path, i)
+}
+
+// tail 从新到旧翻记录文件，返回 room 最近的 n 行（按时间顺序）
+// 它在调用者自己的 Goroutine 里读文件，不经过 broadcaster
+func (t *transcript) tail(room string, n int) ([]string, error) {
+	var result []string
+	for i := 0; i <= t.keep && len(result) < n; i++ {
+		path := t.path
+		if i > 0 {
+			path = t.rotated(i)
+		}
+		lines, err := grepRoom(path, room)
+		if os.IsNotExist(err) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		// 旧文件里的行排在前面
+		if need := n - len(result); len(lines) > need {
+			lines = lines[len(lines)-need:]
+		}
+		result = append(lines, result...)
+	}
+	return result, nil
+}
+
+// grepRoom 读出文件里属于 room 的所有行，去掉房间名
+func grepRoom(path, room string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var lines []string
+	input := bufio.NewScanner(f)
+	input.Buffer(make([]byte, 64*1024), 1<<20)
+	for input.Scan() {
+		ts, rest, ok := strings.Cut(input.Text(), " ")
+		if !ok {
+			continue
+		}
+		r, text, ok := strings.Cut(rest, " ")
+		if ok && r == room {
+			lines = append(lines, ts+" "+text)
+		}
+	}
+	return lines, input.Err()
+}
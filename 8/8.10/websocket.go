@@ -0,0 +1,362 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	_ "embed"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// --- WebSocket 网关 ---
+// 浏览器不能直接连 TCP，所以另开一个 HTTP 端口（-http）:
+//
+//	GET /    内嵌的网页客户端（chat.html）
+//	GET /ws  升级成 WebSocket，之后和 TCP 客户端走完全一样的 handleConn
+//
+// wsConn 把 WebSocket 包装成 net.Conn：每个文本帧当作一行输入，
+// 每写出一行就发一个文本帧。这样昵称握手、命令、房间、慢客户端保护和空闲超时
+// 都不需要为浏览器另写一份。
+// 只用标准库实现了 RFC 6455 里聊天用得到的部分：握手、掩码、分片、ping/pong 和关闭。
+//
+// 浏览器里任何网页都能向 /ws 发起连接，所以握手时检查 Origin：默认只接受和 Host 相同的来源
+// （也就是这里提供的网页），别的来源要写进 -ws-origins。没有 Origin 的不是浏览器，照常放行。
+
+var (
+	httpAddr  = flag.String("http", "localhost:8080", "serve the browser client and the WebSocket gateway here (empty disables)")
+	wsOrigins = flag.String("ws-origins", "", "comma-separated extra origins allowed to open WebSockets, e.g. https://chat.example.com (same-host pages are always allowed)")
+)
+
+//go:embed chat.html
+var chatPage []byte
+
+const (
+	wsGUID         = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11" // RFC 6455 规定的固定字符串
+	wsMaxMessage   = 64 * 1024                              // 一条消息（所有分片加起来）的上限
+	wsCloseTimeout = time.Second                            // 发送关闭帧最多等这么久
+
+	wsOpContinuation = 0x0
+	wsOpText         = 0x1
+	wsOpBinary       = 0x2
+	wsOpClose        = 0x8
+	wsOpPing         = 0x9
+	wsOpPong         = 0xA
+)
+
+// serveHTTP 启动网页客户端和 WebSocket 网关
+func serveHTTP(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/" {
+			http.NotFound(w, req)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write(chatPage)
+	})
+	mux.HandleFunc("/ws", upgrade)
+
+	if *tlsCert != "" {
+		log.Printf("网页客户端: https://%s/", addr)
+		log.Fatal(http.ListenAndServeTLS(addr, *tlsCert, *tlsKey, mux))
+	}
+	log.Printf("网页客户端: http://%s/", addr)
+	log.Fatal(http.ListenAndServe(addr, mux))
+}
+
+// upgrade 完成 WebSocket 握手，然后把连接交给 handleConn
+func upgrade(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet ||
+		!headerHas(req.Header, "Connection", "upgrade") ||
+		!headerHas(req.Header, "Upgrade", "websocket") {
+		http.Error(w, "需要 WebSocket 握手", http.StatusBadRequest)
+		return
+	}
+	if req.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "只支持 WebSocket 版本 13", http.StatusUpgradeRequired)
+		return
+	}
+	key := req.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		http.Error(w, "缺少 Sec-WebSocket-Key", http.StatusBadRequest)
+		return
+	}
+	if !originAllowed(req) {
+		http.Error(w, "不接受来自 "+req.Header.Get("Origin")+" 的网页", http.StatusForbidden)
+		return
+	}
+	if ip, _, err := net.SplitHostPort(req.RemoteAddr); err == nil && bans.bannedIP(ip) {
+		http.Error(w, "你的地址已被封禁", http.StatusForbidden)
+		return
+	}
+
+	conn, rw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// 从这里开始连接归我们管，http.Server 不会再碰它
+	sum := sha1.Sum([]byte(key + wsGUID))
+	fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\n"+
+		"Upgrade: websocket\r\n"+
+		"Connection: Upgrade\r\n"+
+		"Sec-WebSocket-Accept: %s\r\n\r\n", base64.StdEncoding.EncodeToString(sum[:]))
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{}) // 去掉 http.Server 可能设置过的超时
+
+	handleConn(&wsConn{Conn: conn, r: rw.Reader})
+}
+
+// originAllowed 判断发起握手的网页来源是否可信：和 Host 相同，或者在 -ws-origins 里
+func originAllowed(req *http.Request) bool {
+	origin := req.Header.Get("Origin")
+	if origin == "" {
+		return true // 不是浏览器
+	}
+	if u, err := url.Parse(origin); err == nil && strings.EqualFold(u.Host, req.Host) {
+		return true
+	}
+	for _, allowed := range strings.Split(*wsOrigins, ",") {
+		if allowed = strings.TrimSpace(allowed); allowed != "" && strings.EqualFold(strings.TrimRight(allowed, "/"), origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// headerHas 判断逗号分隔的请求头里是否包含某个值（不区分大小写）
+func headerHas(h http.Header, name, value string) bool {
+	for _, v := range h.Values(name) {
+		for _, s := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(s), value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// wsConn 把一个 WebSocket 连接包装成按行读写的 net.Conn
+// Read 只由 handleConn 的读循环调用；Write 可能来自 clientWriter 和读循环（回 pong），所以要加锁
+// Close 还可能来自 broadcaster（-slow kick），它不能等锁，见 closeWith
+// 截止时间、地址等方法直接用底层连接的
+type wsConn struct {
+	net.Conn
+	r       *bufio.Reader // 握手时 http.Server 可能已经多读了一些数据，所以要从它的缓冲区接着读
+	pending []byte        // 已经收到、还没被 Read 取走的数据
+
+	mu      sync.Mutex // 保护 partial 和底层连接的写
+	partial []byte     // Write 收到的还不满一行的数据
+	closed  atomic.Bool
+}
+
+// Read 每次返回一条文本消息加上换行符，收到关闭帧时返回 io.EOF
+func (c *wsConn) Read(p []byte) (int, error) {
+	for len(c.pending) == 0 {
+		msg, err := c.readMessage()
+		if err != nil {
+			return 0, err
+		}
+		c.pending = append(msg, '\n')
+	}
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// readMessage 读出下一条完整的文本消息，顺带处理控制帧
+func (c *wsConn) readMessage() ([]byte, error) {
+	var msg []byte
+	var opcode byte // 当前消息的类型，0 表示还没开始
+	for {
+		fin, op, payload, err := c.readFrame()
+		if err != nil {
+			return nil, err
+		}
+		switch op {
+		case wsOpPing:
+			if err := c.writeFrame(wsOpPong, payload); err != nil {
+				return nil, err
+			}
+			continue
+		case wsOpPong:
+			continue
+		case wsOpClose:
+			c.closeWith(payload) // 原样回一个关闭帧
+			return nil, io.EOF
+		case wsOpText, wsOpBinary:
+			if opcode != 0 {
+				return nil, c.fail("上一条消息还没结束就开始了新消息")
+			}
+			opcode = op
+		case wsOpContinuation:
+			if opcode == 0 {
+				return nil, c.fail("没有开头的后续分片")
+			}
+		default:
+			return nil, c.fail(fmt.Sprintf("未知的帧类型 %#x", op))
+		}
+
+		if len(msg)+len(payload) > wsMaxMessage {
+			return nil, c.fail("消息太长")
+		}
+		msg = append(msg, payload...)
+		if !fin {
+			continue
+		}
+		if opcode == wsOpBinary {
+			msg, opcode = nil, 0 // 聊天只用文本，二进制消息直接丢掉
+			continue
+		}
+		return msg, nil
+	}
+}
+
+// readFrame 读一个帧并去掉掩码
+func (c *wsConn) readFrame() (fin bool, op byte, payload []byte, err error) {
+	var head [2]byte
+	if _, err = io.ReadFull(c.r, head[:]); err != nil {
+		return
+	}
+	fin, op = head[0]&0x80 != 0, head[0]&0x0F
+	if head[0]&0x70 != 0 {
+		return fin, op, nil, c.fail("没有协商过扩展，RSV 位必须为 0")
+	}
+	if head[1]&0x80 == 0 {
+		return fin, op, nil, c.fail("客户端发来的帧必须带掩码")
+	}
+
+	size := uint64(head[1] & 0x7F)
+	switch size {
+	case 126:
+		var ext [2]byte
+		if _, err = io.ReadFull(c.r, ext[:]); err != nil {
+			return
+		}
+		size = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err = io.ReadFull(c.r, ext[:]); err != nil {
+			return
+		}
+		size = binary.BigEndian.Uint64(ext[:])
+	}
+	if op >= wsOpClose && (size > 125 || !fin) {
+		return fin, op, nil, c.fail("控制帧不能分片，也不能超过 125 字节")
+	}
+	if size > wsMaxMessage {
+		return fin, op, nil, c.fail("消息太长")
+	}
+
+	var mask [4]byte
+	if _, err = io.ReadFull(c.r, mask[:]); err != nil {
+		return
+	}
+	payload = make([]byte, size)
+	if _, err = io.ReadFull(c.r, payload); err != nil {
+		return
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return fin, op, payload, nil
+}
+
+// Write 把数据按行切开，每一行发成一个文本帧；不满一行的部分留到下次
+func (c *wsConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.partial = append(c.partial, p...)
+	for {
+		i := bytes.IndexByte(c.partial, '\n')
+		if i < 0 {
+			break
+		}
+		if err := c.writeFrameLocked(wsOpText, c.partial[:i]); err != nil {
+			return 0, err
+		}
+		c.partial = c.partial[i+1:]
+	}
+	return len(p), nil
+}
+
+func (c *wsConn) writeFrame(op byte, payload []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.writeFrameLocked(op, payload)
+}
+
+// writeFrameLocked 发一个不分片、不带掩码的帧（服务器发出的帧不能带掩码）
+// 注意：调用者必须已经持有 c.mu
+func (c *wsConn) writeFrameLocked(op byte, payload []byte) error {
+	if c.closed.Load() {
+		return net.ErrClosed
+	}
+	frame := make([]byte, 0, 10+len(payload))
+	frame = append(frame, 0x80|op)
+	switch n := len(payload); {
+	case n <= 125:
+		frame = append(frame, byte(n))
+	case n <= 0xFFFF:
+		frame = append(frame, 126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(n))
+	default:
+		frame = append(frame, 127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(n))
+	}
+	frame = append(frame, payload...)
+	_, err := c.Conn.Write(frame)
+	return err
+}
+
+// Close 先发关闭帧（1000 正常关闭）再断开 TCP 连接，可以重复调用
+func (c *wsConn) Close() error {
+	return c.closeWith([]byte{0x03, 0xE8})
+}
+
+// fail 因为协议错误关闭连接（1002），返回对应的错误
+func (c *wsConn) fail(reason string) error {
+	log.Printf("WebSocket %s 协议错误: %s", c.RemoteAddr(), reason)
+	c.closeWith([]byte{0x03, 0xEA})
+	return errors.New("websocket: " + reason)
+}
+
+// closeWith 发关闭帧并断开连接，绝不阻塞等锁：
+// 有人正在写的话（比如 clientWriter 卡在一个不读的浏览器上，要等 -write-timeout 才返回），
+// 直接断开 TCP 连接，正在进行的写马上就会失败；这时关闭帧就不发了
+func (c *wsConn) closeWith(payload []byte) error {
+	if !c.mu.TryLock() {
+		if c.closed.Swap(true) {
+			return nil
+		}
+		return c.Conn.Close()
+	}
+	defer c.mu.Unlock()
+	if c.closed.Load() {
+		return nil
+	}
+	c.Conn.SetWriteDeadline(time.Now().Add(wsCloseTimeout))
+	c.writeFrameLocked(wsOpClose, payload) // 尽力而为，对方可能已经走了
+	if c.closed.Swap(true) {
+		return nil // 写的时候被别人断开了
+	}
+	return c.Conn.Close()
+}
@@ -1,7 +1,76 @@
-// 模拟抓取函数
+// Package links 提供爬虫用的链接提取函数
 package links
 
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"time"
+
+	"golang.org/x/net/html"
+)
+
+// client 给每次抓取（包括重定向和读完响应）最多 10 秒，免得一个卡住的网站拖住整个爬虫
+var client = &http.Client{Timeout: 10 * time.Second}
+
+// Extract 向给定的 URL 发起 HTTP GET 请求，解析返回的 HTML，
+// 返回页面里所有 <a href> 指向的网页链接。
+// 相对链接按重定向之后的最终地址解析成绝对地址，去掉 #片段；
+// 只保留 http 和 https 链接，javascript:、mailto: 之类的都丢掉。
 func Extract(url string) ([]string, error) {
-	// 模拟返回几个假链接
-	return []string{url + "/a", url + "/b"}, nil
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("获取 %s 失败: %s", url, resp.Status)
+	}
+	ct := resp.Header.Get("Content-Type")
+	if mediaType, _, _ := mime.ParseMediaType(ct); mediaType != "text/html" {
+		return nil, fmt.Errorf("%s 不是 HTML（Content-Type: %q）", url, ct)
+	}
+
+	doc, err := html.Parse(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("解析 %s 的 HTML 失败: %v", url, err)
+	}
+
+	var links []string
+	visitNode := func(n *html.Node) {
+		if n.Type != html.ElementNode || n.Data != "a" {
+			return
+		}
+		for _, a := range n.Attr {
+			if a.Key != "href" {
+				continue
+			}
+			// resp.Request 是最后一次请求，它的 URL 就是重定向之后的地址
+			link, err := resp.Request.URL.Parse(a.Val)
+			if err != nil {
+				continue // 忽略写错了的链接
+			}
+			if link.Scheme != "http" && link.Scheme != "https" {
+				continue
+			}
+			link.Fragment, link.RawFragment = "", ""
+			links = append(links, link.String())
+		}
+	}
+	forEachNode(doc, visitNode, nil)
+	return links, nil
+}
+
+// forEachNode 对以 n 为根的树中的每个节点调用 pre(n) 和 post(n)，两个函数都是可选的
+// pre 在子节点被访问前调用（前序），post 在访问后调用（后序）
+func forEachNode(n *html.Node, pre, post func(n *html.Node)) {
+	if pre != nil {
+		pre(n)
+	}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		forEachNode(c, pre, post)
+	}
+	if post != nil {
+		post(n)
+	}
 }
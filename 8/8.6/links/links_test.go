@@ -0,0 +1,62 @@
+package links
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+)
+
+func newServer(t *testing.T) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/start", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/dir/page.html", http.StatusFound)
+	})
+	mux.HandleFunc("/dir/page.html", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write([]byte(`<html><body>
+<a href="sub.html#part2">相对</a>
+<a href="../up.html">上一级</a>
+<a href="/abs?q=1#top">绝对路径</a>
+<a href="https://example.com/x#y">别的网站</a>
+<a href="javascript:alert(1)">脚本</a>
+<a href="mailto:someone@example.com">邮件</a>
+<a name="no-href">没有 href</a>
+</body></html>`))
+	})
+	mux.HandleFunc("/missing", http.NotFound)
+	mux.HandleFunc("/plain", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(`<a href="/not-a-link">`))
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestExtract(t *testing.T) {
+	srv := newServer(t)
+	got, err := Extract(srv.URL + "/start")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 相对链接按重定向之后的 /dir/page.html 解析，#片段去掉，javascript: 和 mailto: 丢掉
+	want := []string{
+		srv.URL + "/dir/sub.html",
+		srv.URL + "/up.html",
+		srv.URL + "/abs?q=1",
+		"https://example.com/x",
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("Extract = %q, 想要 %q", got, want)
+	}
+}
+
+func TestExtractRejects(t *testing.T) {
+	srv := newServer(t)
+	for _, path := range []string{"/missing", "/plain"} {
+		if links, err := Extract(srv.URL + path); err == nil {
+			t.Errorf("Extract(%s) = %q，应该返回错误", path, links)
+		}
+	}
+}
@@ -1,3 +1,5 @@
 module github.com/C7107/go_projects
 
 go 1.25.5
+
+require golang.org/x/net v0.57.0